@@ -20,67 +20,240 @@ type Absolute float64
 type DeduplicationParams struct {
 	Threshold interface{}
 	Interval  time.Duration
+	// MaxKeys limits the number of series keys whose last sent sample is kept for
+	// the group, the least recently seen keys are evicted first. 0 means no limit.
+	MaxKeys int
+	// IdleTTL evicts the keys that have not been seen for this long, 0 keeps them.
+	IdleTTL time.Duration
+	// EmitLastSuppressed sends the last suppressed value of a key, with its own
+	// timestamp, right before the value that exceeds the threshold, so a flat
+	// stretch is drawn flat and followed by a step.
+	EmitLastSuppressed bool
 }
 type DataCompacter struct {
-	buffer      map[string]map[string]sample
+	buffer      map[string]*compacterGroup
 	groupParams map[string]DeduplicationParams
+	rules       []compiledRule
+	// released are the swinging-door candidates of evicted keys not yet returned
+	// by Filter or Flush, lastFlush is when Flush was last called.
+	released  []*net.SeriesCommand
+	lastFlush time.Time
+	now       func() time.Time
 	sync.Mutex
 }
 
 func NewDataCompacter(groupParams map[string]DeduplicationParams) *DataCompacter {
-	dc := DataCompacter{buffer: map[string]map[string]sample{}, groupParams: groupParams}
+	dc := DataCompacter{buffer: map[string]*compacterGroup{}, groupParams: groupParams, now: time.Now}
 	for group := range groupParams {
-		dc.buffer[group] = map[string]sample{}
+		dc.buffer[group] = newCompacterGroup()
 	}
 	return &dc
 }
 
+// SetGroupParams replaces the deduplication groups. The last sent samples of the
+// groups that are kept stay in place, those of removed groups are discarded
+// after their held swinging-door candidates are released.
+func (self *DataCompacter) SetGroupParams(groupParams map[string]DeduplicationParams) {
+	self.Lock()
+	defer self.Unlock()
+	buffer := map[string]*compacterGroup{}
+	for group, params := range groupParams {
+		if state, ok := self.buffer[group]; ok {
+			self.released = append(self.released, state.evict(params, self.now())...)
+			buffer[group] = state
+		} else {
+			buffer[group] = newCompacterGroup()
+		}
+	}
+	for group, state := range self.buffer {
+		if _, ok := buffer[group]; !ok {
+			self.released = append(self.released, state.releaseHeld(maxTime)...)
+		}
+	}
+	self.buffer = buffer
+	self.groupParams = groupParams
+}
+
+// SetRules replaces the rules that pick the group of the series filtered
+// without a group of their own.
+func (self *DataCompacter) SetRules(rules []DeduplicationRule) error {
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return err
+	}
+	self.setRules(compiled)
+	return nil
+}
+
+func (self *DataCompacter) setRules(rules []compiledRule) {
+	self.Lock()
+	defer self.Unlock()
+	self.rules = rules
+}
+
+// Filter drops the values that have not changed enough since the last sent value
+// of their series. When group exists its params apply to all the commands,
+// otherwise each metric is filtered by the group of the first rule it matches and
+// is sent as it is if there is none. Swinging-door candidates released since the
+// last call are returned first.
 func (self *DataCompacter) Filter(group string, seriesCommands []*net.SeriesCommand) []*net.SeriesCommand {
 	self.Lock()
 	defer self.Unlock()
-	output := []*net.SeriesCommand{}
-
-	if _, ok := self.buffer[group]; ok {
-		for _, seriesCommand := range seriesCommands {
-			if seriesCommand.Timestamp() != nil {
-				timestamp := *seriesCommand.Timestamp()
-				var newSc *net.SeriesCommand
-				for metric, val := range seriesCommand.Metrics() {
-					key := getKey(seriesCommand.Entity(), metric, seriesCommand.Tags())
-					if _, ok := self.buffer[group][key]; !ok ||
-						hasChangedEnough(self.buffer[group][key].Value, val, self.groupParams[group].Threshold) ||
-						time.Duration(timestamp-self.buffer[group][key].Time)*time.Millisecond >= self.groupParams[group].Interval ||
-						time.Duration(timestamp-self.buffer[group][key].Time)*time.Millisecond < 0 {
-
-						if newSc == nil {
-							newSc = net.NewSeriesCommand(seriesCommand.Entity(), metric, val).SetTimestamp(timestamp)
-							for name, val := range seriesCommand.Tags() {
-								newSc.SetTag(name, val)
-							}
-						} else {
-							newSc.SetMetricValue(metric, val)
-						}
-
-						if _, ok := self.buffer[group][key]; !ok ||
-							time.Duration(timestamp-self.buffer[group][key].Time)*time.Millisecond > 0 {
-
-							self.buffer[group][key] = sample{Time: timestamp, Value: val}
-						}
-					}
-				}
-				if newSc != nil {
-					output = append(output, newSc)
-				}
-			} else {
-				output = append(output, seriesCommand)
+	output := append([]*net.SeriesCommand{}, self.released...)
+	self.released = nil
+
+	_, explicit := self.buffer[group]
+	if !explicit && len(self.rules) == 0 {
+		return append(output, seriesCommands...)
+	}
+	now := self.now()
+	filtered := map[string]bool{}
+	if explicit {
+		filtered[group] = true
+	}
+	for _, seriesCommand := range seriesCommands {
+		if seriesCommand.Timestamp() == nil {
+			output = append(output, seriesCommand)
+			continue
+		}
+		groups := self.metricGroups(group, explicit, seriesCommand)
+		if len(groups) == 0 {
+			output = append(output, seriesCommand)
+			continue
+		}
+		timestamp := *seriesCommand.Timestamp()
+		var newSc *net.SeriesCommand
+		for metric, val := range seriesCommand.Metrics() {
+			value := sample{Time: timestamp, Value: val}
+			metricGroup, ok := groups[metric]
+			if !ok {
+				newSc = withMetric(newSc, seriesCommand, metric, value)
+				continue
+			}
+			filtered[metricGroup] = true
+			key := getKey(seriesCommand.Entity(), metric, seriesCommand.Tags())
+			earlier, send := self.buffer[metricGroup].filter(key, seriesOrigin{seriesCommand, metric}, value, self.groupParams[metricGroup], now)
+			if earlier != nil {
+				output = append(output, withMetric(nil, seriesCommand, metric, *earlier))
 			}
+			if send {
+				newSc = withMetric(newSc, seriesCommand, metric, value)
+			}
+		}
+		if newSc != nil {
+			output = append(output, newSc)
 		}
-	} else {
-		output = append(output, seriesCommands...)
+	}
+	for group := range filtered {
+		output = append(output, self.buffer[group].evict(self.groupParams[group], now)...)
 	}
 	return output
 }
 
+// Evict applies MaxKeys and IdleTTL to every group. Filter only evicts from the
+// groups it filters, Evict is called periodically for the groups no longer fed.
+// The released swinging-door candidates are returned by the next Filter or Flush.
+func (self *DataCompacter) Evict() {
+	self.Lock()
+	defer self.Unlock()
+	now := self.now()
+	for group, state := range self.buffer {
+		self.released = append(self.released, state.evict(self.groupParams[group], now)...)
+	}
+}
+
+// maxTime is later than any time a key is seen.
+var maxTime = time.Unix(1<<62, 0)
+
+// Flush returns the swinging-door candidates held for the keys that were not seen
+// since the previous Flush or for longer than the Interval of their group, and
+// those released by evictions. Storage calls it on every update, so the last point
+// of a series that stops is still sent.
+func (self *DataCompacter) Flush() []*net.SeriesCommand {
+	return self.flush(false)
+}
+
+// flush with all set returns every held candidate, it is called on Close.
+func (self *DataCompacter) flush(all bool) []*net.SeriesCommand {
+	self.Lock()
+	defer self.Unlock()
+	now := self.now()
+	output := append([]*net.SeriesCommand{}, self.released...)
+	self.released = nil
+	for group, state := range self.buffer {
+		params := self.groupParams[group]
+		if _, ok := params.Threshold.(SwingingDoor); !ok {
+			continue
+		}
+		seenBefore := self.lastFlush
+		if all {
+			seenBefore = maxTime
+		} else if params.Interval > 0 && now.Add(-params.Interval).After(seenBefore) {
+			seenBefore = now.Add(-params.Interval)
+		}
+		output = append(output, state.releaseHeld(seenBefore)...)
+	}
+	self.lastFlush = now
+	return output
+}
+
+// metricGroups maps the metrics of the command to the groups filtering them.
+func (self *DataCompacter) metricGroups(group string, explicit bool, seriesCommand *net.SeriesCommand) map[string]string {
+	groups := map[string]string{}
+	for metric := range seriesCommand.Metrics() {
+		if explicit {
+			groups[metric] = group
+		} else if ruleGroup, ok := matchRules(self.rules, seriesCommand.Entity(), metric, seriesCommand.Tags()); ok {
+			if _, ok := self.buffer[ruleGroup]; ok {
+				groups[metric] = ruleGroup
+			}
+		}
+	}
+	return groups
+}
+
+// withMetric adds the metric value to command, creating it with the entity and
+// tags of source when command is nil.
+func withMetric(command, source *net.SeriesCommand, metric string, value sample) *net.SeriesCommand {
+	if command != nil {
+		command.SetMetricValue(metric, value.Value)
+		return command
+	}
+	command = net.NewSeriesCommand(source.Entity(), metric, value.Value).SetTimestamp(value.Time)
+	for name, val := range source.Tags() {
+		command.SetTag(name, val)
+	}
+	return command
+}
+
+// SelfMetricValues reports the number of keys kept and evicted for every group.
+func (self *DataCompacter) SelfMetricValues() []*metricValue {
+	self.Lock()
+	defer self.Unlock()
+	groups := make([]string, 0, len(self.buffer))
+	for group := range self.buffer {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	metricValues := []*metricValue{}
+	for _, group := range groups {
+		state := self.buffer[group]
+		metricValues = append(metricValues,
+			&metricValue{
+				name:  "compacter.keys.count",
+				tags:  map[string]string{"group": group},
+				value: net.Int64(state.order.Len()),
+			},
+			&metricValue{
+				name:  "compacter.keys.evicted",
+				tags:  map[string]string{"group": group},
+				value: net.Int64(state.evicted),
+			},
+		)
+	}
+	return metricValues
+}
+
 func hasChangedEnough(oldValue, newValue net.Number, threshold interface{}) bool {
 	switch thrVal := threshold.(type) {
 	case Percent:
@@ -0,0 +1,132 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"strings"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+const (
+	SeriesCommandType    = "series"
+	PropertyCommandType  = "property"
+	MessageCommandType   = "message"
+	EntityTagCommandType = "entity-tag"
+)
+
+// Batch is a set of commands sent together by Storage.SendAndWait.
+type Batch struct {
+	SeriesCommands    []*net.SeriesCommand
+	PropertyCommands  []*net.PropertyCommand
+	MessageCommands   []*net.MessageCommand
+	EntityTagCommands []*net.EntityTagCommand
+}
+
+// SendError reports that the commands of one type could not be sent.
+type SendError struct {
+	// CommandType is one of SeriesCommandType, PropertyCommandType, MessageCommandType or EntityTagCommandType.
+	CommandType string
+	// Count is the number of commands of that type that may not have been delivered.
+	Count int
+	// StatusCode is the HTTP status returned by ATSD, 0 for network transports or if there was no response.
+	StatusCode int
+	Err        error
+}
+
+func (self *SendError) Error() string {
+	if self.StatusCode != 0 {
+		return fmt.Sprintf("could not send %v %v commands, status %v: %v", self.Count, self.CommandType, self.StatusCode, self.Err)
+	}
+	return fmt.Sprintf("could not send %v %v commands: %v", self.Count, self.CommandType, self.Err)
+}
+
+func newSendError(commandType string, count int, err error) *SendError {
+	return &SendError{CommandType: commandType, Count: count, StatusCode: responseStatus(err), Err: err}
+}
+
+// BatchError is returned by SendAndWait with one SendError per failed command type.
+type BatchError []*SendError
+
+func (self BatchError) Error() string {
+	messages := make([]string, 0, len(self))
+	for _, sendError := range self {
+		messages = append(messages, sendError.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Get returns the error for the command type, or nil if those commands were sent.
+func (self BatchError) Get(commandType string) *SendError {
+	for _, sendError := range self {
+		if sendError.CommandType == commandType {
+			return sendError
+		}
+	}
+	return nil
+}
+
+func (self BatchError) errorOrNil() error {
+	if len(self) == 0 {
+		return nil
+	}
+	return self
+}
+
+// StatusError is returned when ATSD responds with a status other than 2xx.
+type StatusError struct {
+	// Code is the HTTP status code and Status the status line, e.g. "400 Bad Request".
+	Code   int
+	Status string
+	// Request names the failed request, e.g. "POST /api/v1/series/insert".
+	Request string
+}
+
+func (self *StatusError) Error() string {
+	return self.Request + ": " + self.Status
+}
+func (self *StatusError) StatusCode() int {
+	return self.Code
+}
+
+// responseStatus returns the HTTP status code of the response that caused err,
+// provided by a StatusCode method of err or of an error it wraps, or 0.
+func responseStatus(err error) int {
+	var statusError interface {
+		StatusCode() int
+	}
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode()
+	}
+	return 0
+}
+
+// isPermanent reports whether ATSD rejected the request as invalid, so that sending
+// the same commands again cannot succeed. 4xx responses are permanent except for
+// 408 Request Timeout and 429 Too Many Requests, and for 401, 403, 404 and 407,
+// which point at credentials or the url and are retried until they are fixed.
+func isPermanent(err error) bool {
+	switch status := responseStatus(err); status {
+	case nethttp.StatusUnauthorized, nethttp.StatusForbidden, nethttp.StatusNotFound, nethttp.StatusProxyAuthRequired,
+		nethttp.StatusRequestTimeout, nethttp.StatusTooManyRequests:
+		return false
+	default:
+		return status >= 400 && status < 500
+	}
+}
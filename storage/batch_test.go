@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+func TestResponseStatus(t *testing.T) {
+	cases := []struct {
+		Err    error
+		Status int
+	}{
+		{errors.New("dial tcp 127.0.0.1:8088: connection refused"), 0},
+		{&StatusError{Code: 401, Status: "401 Unauthorized", Request: "POST /api/v1/series/insert"}, 401},
+		{fmt.Errorf("insert failed: %w", &StatusError{Code: 400, Status: "400 Bad Request"}), 400},
+	}
+	for _, c := range cases {
+		if status := responseStatus(c.Err); status != c.Status {
+			t.Error("unexpected status for '", c.Err, "': ", status, " expected: ", c.Status)
+		}
+	}
+}
+
+func TestSendAndWait(t *testing.T) {
+	listener, lines := listenCommands(t)
+	defer listener.Close()
+
+	config := GetDefaultConfig()
+	config.Url = &url.URL{Scheme: "tcp", Host: listener.Addr().String()}
+	storage, err := NewFactoryFromConfig(config).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer storage.Close(ctx)
+
+	batch := &Batch{
+		SeriesCommands:  seriesCommands("entity001", 3),
+		MessageCommands: []*net.MessageCommand{net.NewMessageCommand("entity001", "message001")},
+	}
+	if err := storage.SendAndWait(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-lines:
+		case <-time.After(5 * time.Second):
+			t.Fatal("only ", i, " commands received")
+		}
+	}
+
+	unreachable, err := NewNetworkCommunicator(1, &url.URL{Scheme: "tcp", Host: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unreachable.Close(ctx)
+	err = unreachable.SendAndWait(ctx, batch)
+	batchError, ok := err.(BatchError)
+	if !ok {
+		t.Fatal("expected BatchError, got: ", err)
+	}
+	if sendError := batchError.Get(SeriesCommandType); sendError == nil || sendError.Count != 3 {
+		t.Error("unexpected series send error: ", sendError)
+	}
+	if sendError := batchError.Get(MessageCommandType); sendError == nil || sendError.Count != 1 {
+		t.Error("unexpected message send error: ", sendError)
+	}
+	if batchError.Get(PropertyCommandType) != nil {
+		t.Error("unexpected property send error")
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	for status, expected := range map[int]bool{
+		400: true,
+		401: false,
+		403: false,
+		404: false,
+		429: false,
+		408: false,
+		500: false,
+	} {
+		if isPermanent(&StatusError{Code: status}) != expected {
+			t.Errorf("expected isPermanent(%v) to be %v", status, expected)
+		}
+	}
+	if isPermanent(errors.New("connection refused")) {
+		t.Error("expected a network error not to be permanent")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+type compacterEntry struct {
+	key      string
+	sample   sample
+	lastSeen time.Time
+	// suppressed is the last value not sent after sample, if it is kept.
+	suppressed *sample
+	door       swingingDoorState
+}
+
+// compacterGroup keeps the last sent sample of every series key of a deduplication
+// group, ordered from the most to the least recently seen key.
+type compacterGroup struct {
+	entries map[string]*list.Element
+	order   *list.List
+	evicted uint64
+}
+
+func newCompacterGroup() *compacterGroup {
+	return &compacterGroup{entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// get returns the last sent sample of the key and marks the key as seen.
+func (self *compacterGroup) get(key string, now time.Time) (sample, bool) {
+	element, ok := self.entries[key]
+	if !ok {
+		return sample{}, false
+	}
+	entry := element.Value.(*compacterEntry)
+	entry.lastSeen = now
+	self.order.MoveToFront(element)
+	return entry.sample, true
+}
+
+func (self *compacterGroup) set(key string, value sample, now time.Time) {
+	if element, ok := self.entries[key]; ok {
+		entry := element.Value.(*compacterEntry)
+		entry.sample = value
+		entry.suppressed = nil
+		entry.lastSeen = now
+		self.order.MoveToFront(element)
+		return
+	}
+	self.entries[key] = self.order.PushFront(&compacterEntry{key: key, sample: value, lastSeen: now})
+}
+
+// filter decides whether the value of the key is sent. It returns the value held
+// back before it that has to be sent first, if any.
+func (self *compacterGroup) filter(key string, origin seriesOrigin, value sample, params DeduplicationParams, now time.Time) (*sample, bool) {
+	if deviation, ok := params.Threshold.(SwingingDoor); ok {
+		return self.swingingDoor(key, origin, value, float64(deviation), params.Interval, now)
+	}
+	last, seen := self.get(key, now)
+	changed := seen && hasChangedEnough(last.Value, value.Value, params.Threshold)
+	elapsed := time.Duration(value.Time-last.Time) * time.Millisecond
+	if seen && !changed && elapsed < params.Interval && elapsed >= 0 {
+		if params.EmitLastSuppressed {
+			self.suppress(key, value)
+		}
+		return nil, false
+	}
+
+	var earlier *sample
+	if suppressed := self.lastSuppressed(key); changed && params.EmitLastSuppressed &&
+		suppressed != nil && suppressed.Time > last.Time && suppressed.Time < value.Time {
+		earlier = suppressed
+	}
+	if !seen || elapsed > 0 {
+		self.set(key, value, now)
+	}
+	return earlier, true
+}
+
+// suppress keeps the value of the key that was not sent.
+func (self *compacterGroup) suppress(key string, value sample) {
+	if element, ok := self.entries[key]; ok {
+		element.Value.(*compacterEntry).suppressed = &value
+	}
+}
+
+// lastSuppressed returns the last value of the key that was not sent after its
+// last sent sample, or nil.
+func (self *compacterGroup) lastSuppressed(key string) *sample {
+	if element, ok := self.entries[key]; ok {
+		return element.Value.(*compacterEntry).suppressed
+	}
+	return nil
+}
+
+// evict removes the keys idle for longer than params.IdleTTL and then the least
+// recently seen keys above params.MaxKeys. It returns the commands sending the
+// swinging-door candidates the evicted keys held.
+func (self *compacterGroup) evict(params DeduplicationParams, now time.Time) []*net.SeriesCommand {
+	released := []*net.SeriesCommand{}
+	for element := self.order.Back(); element != nil; element = self.order.Back() {
+		entry := element.Value.(*compacterEntry)
+		idle := params.IdleTTL > 0 && now.Sub(entry.lastSeen) > params.IdleTTL
+		if !idle && (params.MaxKeys <= 0 || self.order.Len() <= params.MaxKeys) {
+			break
+		}
+		if command := entry.release(); command != nil {
+			released = append(released, command)
+		}
+		self.order.Remove(element)
+		delete(self.entries, entry.key)
+		self.evicted++
+	}
+	return released
+}
+
+// releaseHeld returns the commands sending the swinging-door candidates of the
+// keys not seen after seenBefore.
+func (self *compacterGroup) releaseHeld(seenBefore time.Time) []*net.SeriesCommand {
+	released := []*net.SeriesCommand{}
+	for element := self.order.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*compacterEntry)
+		if entry.lastSeen.After(seenBefore) {
+			break
+		}
+		if command := entry.release(); command != nil {
+			released = append(released, command)
+		}
+	}
+	return released
+}
@@ -1,7 +1,12 @@
 package storage
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	neturl "net/url"
@@ -15,11 +20,83 @@ type Config struct {
 	SenderGoroutineLimit int
 	MemstoreLimit        uint
 
+	// MemstoreByteLimit caps the estimated memory used by the memstore, 0 means no cap.
+	MemstoreByteLimit      ByteSize
+	MemstoreQuotas         MemStoreQuotas
+	MemstoreOverflowPolicy OverflowPolicy
+	// MemstoreBlockTimeout is how long appends wait for room under the Block policy.
+	MemstoreBlockTimeout time.Duration
+
+	// FailoverUrls are tried in order when Url fails FailoverThreshold consecutive times.
+	// The primary Url is probed every FailbackProbeInterval and used again once it responds.
+	// udp and unixgram primaries cannot be probed, they are not failed back to.
+	// tcp, udp, http and https urls may be mixed, http endpoints receive the commands through the command API.
+	FailoverUrls          []*neturl.URL
+	FailoverThreshold     int
+	FailbackProbeInterval time.Duration
+
+	// UdpPayloadSize is the largest datagram sent to udp and unixgram urls, the default fits a 1500 byte MTU
+	// with room for IPv6 and tunnel headers. Commands are never split between datagrams,
+	// a command larger than this is dropped.
+	UdpPayloadSize ByteSize
+
+	// HttpMaxBatchSize is the largest number of series, property or message commands
+	// sent in one request by the http communicator.
+	HttpMaxBatchSize int
+
+	// ReplicaUrls are extra destinations that receive a copy of everything sent to Url.
+	// Without SpilloverDir, the batches a destination cannot keep up with are dropped
+	// for it, and the write-ahead log does not keep them.
+	ReplicaUrls []*neturl.URL
+
+	// Username with the password read from PasswordFile or from the PasswordEnv
+	// environment variable authenticate requests to http and https urls, so the
+	// password does not have to be part of the url.
+	Username     string
+	PasswordFile string
+	PasswordEnv  string
+	// BearerToken, or the token read from BearerTokenFile, is sent as an API token
+	// instead of basic auth.
+	BearerToken     string
+	BearerTokenFile string
+
 	InsecureSkipVerify bool
+	// TLSCAFile, TLSCertFile, TLSKeyFile and TLSServerName configure tls, tcp+tls and
+	// https urls. The CA bundle and client certificate are PEM files.
+	TLSCAFile     string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSServerName string
 
 	UpdateInterval time.Duration
 
 	GroupParams map[string]DeduplicationParams
+	// DeduplicationRules pick the group of series queued without a group in
+	// GroupParams by metric, entity and tags. The first matching rule wins.
+	DeduplicationRules []DeduplicationRule
+	// MetadataRefreshInterval enables the deduplication of property and entity tag
+	// commands: a command repeating the content last delivered for its property or entity
+	// is dropped until this long has passed. 0 sends every command.
+	MetadataRefreshInterval time.Duration
+
+	// WriteAheadLogDir enables the memstore write-ahead log when not empty.
+	WriteAheadLogDir string
+
+	// SpilloverDir enables spilling released data to disk while the destination is unreachable.
+	// With ReplicaUrls, every destination also spills to its own subdirectory while it is down.
+	SpilloverDir     string
+	SpilloverMaxSize ByteSize
+	SpilloverMaxAge  time.Duration
+
+	// Listener, if set, is notified about connection changes, send errors, retries and dropped commands.
+	Listener Listener
+	// DeadLetterHandler, if set, receives the commands that ATSD rejected with a 4xx
+	// response or that were dropped. Otherwise rejected commands are logged. A handler
+	// that is also a DeadLetterSink is closed with the Storage.
+	DeadLetterHandler DeadLetterHandler
+	// DeadLetterFile, if set, is appended with those commands by a FileDeadLetterSink
+	// instead. It cannot be combined with DeadLetterHandler.
+	DeadLetterFile string
 }
 
 func GetDefaultConfig() Config {
@@ -29,12 +106,197 @@ func GetDefaultConfig() Config {
 	}
 	hostname, _ := os.Hostname()
 	return Config{
-		Url:                  urlStruct,
-		MetricPrefix:         "storagedriver",
-		SelfMetricEntity:     hostname,
-		SenderGoroutineLimit: 1,
-		MemstoreLimit:        1000000,
-		UpdateInterval:       1 * time.Minute,
-		GroupParams:          map[string]DeduplicationParams{},
+		Url:                   urlStruct,
+		MetricPrefix:          "storagedriver",
+		SelfMetricEntity:      hostname,
+		SenderGoroutineLimit:  1,
+		MemstoreLimit:         1000000,
+		MemstoreBlockTimeout:  5 * time.Second,
+		UpdateInterval:        1 * time.Minute,
+		GroupParams:           map[string]DeduplicationParams{},
+		SpilloverMaxSize:      1 << 30,
+		SpilloverMaxAge:       24 * time.Hour,
+		FailoverThreshold:     3,
+		UdpPayloadSize:        1400,
+		HttpMaxBatchSize:      1000,
+		FailbackProbeInterval: 30 * time.Second,
+	}
+}
+
+// ConfigError lists all the problems found in a Config.
+type ConfigError struct {
+	Problems []string
+}
+
+func (self *ConfigError) Error() string {
+	return "invalid config: " + strings.Join(self.Problems, "; ")
+}
+
+// Validate checks the config and returns a *ConfigError listing every problem, or nil.
+func (self Config) Validate() error {
+	problems := []string{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if self.Url == nil {
+		problem("Url is not set")
+	}
+	for _, urls := range []struct {
+		name string
+		urls []*neturl.URL
+	}{
+		{"Url", []*neturl.URL{self.Url}},
+		{"FailoverUrls", self.FailoverUrls},
+		{"ReplicaUrls", self.ReplicaUrls},
+	} {
+		for _, url := range urls.urls {
+			if url == nil {
+				continue
+			}
+			switch url.Scheme {
+			case "tcp", "udp", "tls", "tcp+tls", "http", "https":
+				if url.Host == "" {
+					problem("%v %v has no host", urls.name, redact(url.String()))
+				}
+			case "unix", "unixgram":
+				if url.Host+url.Path == "" {
+					problem("%v %v has no socket path", urls.name, redact(url.String()))
+				}
+			default:
+				problem("%v %v has unsupported scheme %q", urls.name, redact(url.String()), url.Scheme)
+			}
+		}
+	}
+
+	if self.SenderGoroutineLimit <= 0 {
+		problem("SenderGoroutineLimit should be > 0, got %v", self.SenderGoroutineLimit)
+	}
+	if self.MemstoreLimit < minMemoryLimit {
+		problem("MemstoreLimit should be >= %v, got %v", minMemoryLimit, self.MemstoreLimit)
+	}
+	if _, ok := overflowPolicyNamesByValue()[self.MemstoreOverflowPolicy]; !ok {
+		problem("unknown MemstoreOverflowPolicy %v", self.MemstoreOverflowPolicy)
+	}
+	if self.UpdateInterval <= 0 {
+		problem("UpdateInterval should be > 0, got %v", self.UpdateInterval)
+	}
+	if len(self.FailoverUrls) > 0 && self.FailoverThreshold <= 0 {
+		problem("FailoverThreshold should be > 0, got %v", self.FailoverThreshold)
+	}
+	if self.HttpMaxBatchSize < 0 {
+		problem("HttpMaxBatchSize should be >= 0, got %v", self.HttpMaxBatchSize)
+	}
+
+	for _, group := range sortedGroupNames(self.GroupParams) {
+		params := self.GroupParams[group]
+		switch threshold := params.Threshold.(type) {
+		case Percent:
+			if threshold < 0 {
+				problem("group %v: threshold should be >= 0, got %v", group, threshold)
+			}
+		case Absolute:
+			if threshold < 0 {
+				problem("group %v: threshold should be >= 0, got %v", group, threshold)
+			}
+		case SwingingDoor:
+			if threshold < 0 {
+				problem("group %v: threshold should be >= 0, got %v", group, threshold)
+			}
+		case nil:
+			problem("group %v: threshold is not set", group)
+		default:
+			problem("group %v: threshold should be Percent, Absolute or SwingingDoor, got %T", group, params.Threshold)
+		}
+		if params.Interval < 0 {
+			problem("group %v: interval should be >= 0, got %v", group, params.Interval)
+		}
+		if params.MaxKeys < 0 || params.IdleTTL < 0 {
+			problem("group %v: max keys and idle TTL should be >= 0, got %v and %v", group, params.MaxKeys, params.IdleTTL)
+		}
+	}
+
+	if self.MetadataRefreshInterval < 0 {
+		problem("MetadataRefreshInterval should be >= 0, got %v", self.MetadataRefreshInterval)
+	}
+	problems = append(problems, validateRules(self.DeduplicationRules, self.GroupParams)...)
+
+	// Both directories hold segment files named alike, each would pick up the other's.
+	if self.SpilloverDir != "" && self.WriteAheadLogDir != "" && isSameOrNestedDir(self.SpilloverDir, self.WriteAheadLogDir) {
+		problem("SpilloverDir %v and WriteAheadLogDir %v should not be the same directory or nested", self.SpilloverDir, self.WriteAheadLogDir)
+	}
+
+	if self.PasswordFile != "" && self.PasswordEnv != "" {
+		problem("PasswordFile and PasswordEnv cannot be set together")
+	}
+	if self.Username == "" && (self.PasswordFile != "" || self.PasswordEnv != "") {
+		problem("a password is configured without Username")
+	}
+	if self.BearerToken != "" && self.BearerTokenFile != "" {
+		problem("BearerToken and BearerTokenFile cannot be set together")
+	}
+	if (self.TLSCertFile == "") != (self.TLSKeyFile == "") {
+		problem("TLSCertFile and TLSKeyFile should be set together")
+	}
+	if self.DeadLetterFile != "" && self.DeadLetterHandler != nil {
+		problem("DeadLetterFile and DeadLetterHandler cannot be set together")
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// isSameOrNestedDir reports whether one of the directories is or contains the other.
+func isSameOrNestedDir(dir, other string) bool {
+	dir, _ = filepath.Abs(dir)
+	other, _ = filepath.Abs(other)
+	for _, pair := range [][2]string{{dir, other}, {other, dir}} {
+		relative, err := filepath.Rel(pair[0], pair[1])
+		if err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedGroupNames(groupParams map[string]DeduplicationParams) []string {
+	names := make([]string, 0, len(groupParams))
+	for name := range groupParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ByteSize is a number of bytes, see ParseByteSize.
+type ByteSize uint64
+
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier uint64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseByteSize parses sizes like "256MB", "1.5GB" or "4096". Units are powers of 1024.
+func ParseByteSize(value string) (ByteSize, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := uint64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid byte size: %q", value)
 	}
+	return ByteSize(size * float64(multiplier)), nil
 }
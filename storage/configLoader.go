@@ -0,0 +1,465 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configEnvPrefix is prepended to the upper-cased option name to get its environment
+// variable, e.g. ATSD_URL or ATSD_MEMSTORE_LIMIT.
+const configEnvPrefix = "ATSD_"
+
+type configOption struct {
+	name string
+	set  func(config *Config, value string) error
+}
+
+func stringOption(name string, field func(config *Config) *string) configOption {
+	return configOption{name, func(config *Config, value string) error {
+		*field(config) = value
+		return nil
+	}}
+}
+
+func intOption(name string, field func(config *Config) *int) configOption {
+	return configOption{name, func(config *Config, value string) error {
+		number, err := strconv.Atoi(value)
+		*field(config) = number
+		return err
+	}}
+}
+
+func uintOption(name string, field func(config *Config) *uint) configOption {
+	return configOption{name, func(config *Config, value string) error {
+		number, err := strconv.ParseUint(value, 10, 0)
+		*field(config) = uint(number)
+		return err
+	}}
+}
+
+func boolOption(name string, field func(config *Config) *bool) configOption {
+	return configOption{name, func(config *Config, value string) error {
+		flag, err := strconv.ParseBool(value)
+		*field(config) = flag
+		return err
+	}}
+}
+
+func durationOption(name string, field func(config *Config) *time.Duration) configOption {
+	return configOption{name, func(config *Config, value string) error {
+		duration, err := time.ParseDuration(value)
+		*field(config) = duration
+		return err
+	}}
+}
+
+func byteSizeOption(name string, field func(config *Config) *ByteSize) configOption {
+	return configOption{name, func(config *Config, value string) error {
+		size, err := ParseByteSize(value)
+		*field(config) = size
+		return err
+	}}
+}
+
+func urlOption(name string, field func(config *Config) **neturl.URL) configOption {
+	return configOption{name, func(config *Config, value string) error {
+		url, err := neturl.Parse(value)
+		*field(config) = url
+		return err
+	}}
+}
+
+// urlListOption takes a comma-separated list of urls.
+func urlListOption(name string, field func(config *Config) *[]*neturl.URL) configOption {
+	return configOption{name, func(config *Config, value string) error {
+		urls := []*neturl.URL{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			url, err := neturl.Parse(item)
+			if err != nil {
+				return err
+			}
+			urls = append(urls, url)
+		}
+		*field(config) = urls
+		return nil
+	}}
+}
+
+var configOptions = []configOption{
+	urlOption("url", func(config *Config) **neturl.URL { return &config.Url }),
+	urlListOption("failover_urls", func(config *Config) *[]*neturl.URL { return &config.FailoverUrls }),
+	urlListOption("replica_urls", func(config *Config) *[]*neturl.URL { return &config.ReplicaUrls }),
+	stringOption("metric_prefix", func(config *Config) *string { return &config.MetricPrefix }),
+	stringOption("self_metric_entity", func(config *Config) *string { return &config.SelfMetricEntity }),
+	intOption("sender_goroutine_limit", func(config *Config) *int { return &config.SenderGoroutineLimit }),
+	uintOption("memstore_limit", func(config *Config) *uint { return &config.MemstoreLimit }),
+	byteSizeOption("memstore_byte_limit", func(config *Config) *ByteSize { return &config.MemstoreByteLimit }),
+	uintOption("memstore_series_quota", func(config *Config) *uint { return &config.MemstoreQuotas.SeriesCommands }),
+	uintOption("memstore_property_quota", func(config *Config) *uint { return &config.MemstoreQuotas.PropertyCommands }),
+	uintOption("memstore_message_quota", func(config *Config) *uint { return &config.MemstoreQuotas.MessageCommands }),
+	uintOption("memstore_entity_tag_quota", func(config *Config) *uint { return &config.MemstoreQuotas.EntityTagCommands }),
+	{"memstore_overflow_policy", func(config *Config, value string) error {
+		policy, err := ParseOverflowPolicy(value)
+		config.MemstoreOverflowPolicy = policy
+		return err
+	}},
+	durationOption("memstore_block_timeout", func(config *Config) *time.Duration { return &config.MemstoreBlockTimeout }),
+	intOption("failover_threshold", func(config *Config) *int { return &config.FailoverThreshold }),
+	durationOption("failback_probe_interval", func(config *Config) *time.Duration { return &config.FailbackProbeInterval }),
+	byteSizeOption("udp_payload_size", func(config *Config) *ByteSize { return &config.UdpPayloadSize }),
+	intOption("http_max_batch_size", func(config *Config) *int { return &config.HttpMaxBatchSize }),
+	stringOption("username", func(config *Config) *string { return &config.Username }),
+	stringOption("password_file", func(config *Config) *string { return &config.PasswordFile }),
+	stringOption("password_env", func(config *Config) *string { return &config.PasswordEnv }),
+	stringOption("bearer_token", func(config *Config) *string { return &config.BearerToken }),
+	stringOption("bearer_token_file", func(config *Config) *string { return &config.BearerTokenFile }),
+	boolOption("insecure_skip_verify", func(config *Config) *bool { return &config.InsecureSkipVerify }),
+	stringOption("tls_ca_file", func(config *Config) *string { return &config.TLSCAFile }),
+	stringOption("tls_cert_file", func(config *Config) *string { return &config.TLSCertFile }),
+	stringOption("tls_key_file", func(config *Config) *string { return &config.TLSKeyFile }),
+	stringOption("tls_server_name", func(config *Config) *string { return &config.TLSServerName }),
+	durationOption("update_interval", func(config *Config) *time.Duration { return &config.UpdateInterval }),
+	stringOption("write_ahead_log_dir", func(config *Config) *string { return &config.WriteAheadLogDir }),
+	stringOption("spillover_dir", func(config *Config) *string { return &config.SpilloverDir }),
+	byteSizeOption("spillover_max_size", func(config *Config) *ByteSize { return &config.SpilloverMaxSize }),
+	durationOption("spillover_max_age", func(config *Config) *time.Duration { return &config.SpilloverMaxAge }),
+	stringOption("dead_letter_file", func(config *Config) *string { return &config.DeadLetterFile }),
+	durationOption("metadata_refresh_interval", func(config *Config) *time.Duration { return &config.MetadataRefreshInterval }),
+}
+
+// groupParamsOption is the file option holding the deduplication groups, e.g. in YAML:
+//
+//	group_params:
+//	  cpu:
+//	    threshold: 5%
+//	    interval: 30s
+//	    max_keys: 100000
+//	    idle_ttl: 1h
+//	    emit_last_suppressed: true
+//
+// It has no environment variable.
+const groupParamsOption = "group_params"
+
+// deduplicationRulesOption is the file option holding the deduplication rules in
+// order, e.g. in YAML:
+//
+//	deduplication_rules:
+//	  - metric: "cpu_*"
+//	    group: cpu
+//	  - entity: "regex:^nurswgvml\\d+$"
+//	    tags: {file_system: "/dev/*"}
+//	    group: disk
+//
+// It has no environment variable.
+const deduplicationRulesOption = "deduplication_rules"
+
+// LoadConfig reads the config from a YAML or JSON file, picked by the .json
+// extension, on top of GetDefaultConfig, and then applies the ATSD_* environment
+// variables, e.g. ATSD_URL or ATSD_MEMSTORE_LIMIT; list options take
+// comma-separated urls. With an empty path only the environment is applied.
+// Options use snake_case names, thresholds are written as "5%" (Percent), "0.5"
+// (Absolute) or "sdt:0.5" (SwingingDoor), durations as "30s" and sizes as "256MB". The result is
+// checked with Config.Validate, the returned *ConfigError lists the problems of
+// both the file and the environment and of the resulting config.
+func LoadConfig(path string) (Config, error) {
+	config := GetDefaultConfig()
+	problems := []string{}
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return config, err
+		}
+		problems = append(problems, applyConfigValues(&config, values)...)
+	}
+	problems = append(problems, applyConfigEnv(&config, os.LookupEnv)...)
+	if err := config.Validate(); err != nil {
+		problems = append(problems, err.(*ConfigError).Problems...)
+	}
+	if len(problems) > 0 {
+		return config, &ConfigError{Problems: problems}
+	}
+	return config, nil
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(content, &values)
+	} else {
+		err = yaml.Unmarshal(content, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return values, nil
+}
+
+func applyConfigValues(config *Config, values map[string]interface{}) []string {
+	problems := []string{}
+	for _, name := range sortedInterfaceKeys(values) {
+		if name == groupParamsOption {
+			problems = append(problems, applyGroupParams(config, values[name])...)
+			continue
+		}
+		if name == deduplicationRulesOption {
+			problems = append(problems, applyDeduplicationRules(config, values[name])...)
+			continue
+		}
+		option, ok := findConfigOption(name)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown option %v", name))
+			continue
+		}
+		value, err := configValueString(values[name])
+		if err == nil {
+			err = option.set(config, value)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", name, err))
+		}
+	}
+	return problems
+}
+
+func applyConfigEnv(config *Config, lookupEnv func(string) (string, bool)) []string {
+	problems := []string{}
+	for _, option := range configOptions {
+		name := configEnvPrefix + strings.ToUpper(option.name)
+		if value, ok := lookupEnv(name); ok {
+			if err := option.set(config, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%v: %v", name, err))
+			}
+		}
+	}
+	return problems
+}
+
+func applyGroupParams(config *Config, value interface{}) []string {
+	groups, ok := configValueMap(value)
+	if !ok {
+		return []string{fmt.Sprintf("%v: expected a map of groups", groupParamsOption)}
+	}
+	problems := []string{}
+	groupParams := map[string]DeduplicationParams{}
+	for _, group := range sortedInterfaceKeys(groups) {
+		fields, ok := configValueMap(groups[group])
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%v.%v: expected a map of group fields", groupParamsOption, group))
+			continue
+		}
+		params := DeduplicationParams{}
+		for _, field := range sortedInterfaceKeys(fields) {
+			value, err := configValueString(fields[field])
+			if err == nil {
+				switch field {
+				case "threshold":
+					params.Threshold, err = ParseThreshold(value)
+				case "interval":
+					params.Interval, err = time.ParseDuration(value)
+				case "max_keys":
+					params.MaxKeys, err = strconv.Atoi(value)
+				case "idle_ttl":
+					params.IdleTTL, err = time.ParseDuration(value)
+				case "emit_last_suppressed":
+					params.EmitLastSuppressed, err = strconv.ParseBool(value)
+				default:
+					err = fmt.Errorf("unknown field")
+				}
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%v.%v.%v: %v", groupParamsOption, group, field, err))
+			}
+		}
+		groupParams[group] = params
+	}
+	config.GroupParams = groupParams
+	return problems
+}
+
+func applyDeduplicationRules(config *Config, value interface{}) []string {
+	items, ok := value.([]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%v: expected a list of rules", deduplicationRulesOption)}
+	}
+	problems := []string{}
+	rules := []DeduplicationRule{}
+	for i, item := range items {
+		fields, ok := configValueMap(item)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%v[%v]: expected a map of rule fields", deduplicationRulesOption, i))
+			continue
+		}
+		rule := DeduplicationRule{}
+		for _, field := range sortedInterfaceKeys(fields) {
+			var err error
+			switch field {
+			case "metric":
+				rule.Metric, err = configValueString(fields[field])
+			case "entity":
+				rule.Entity, err = configValueString(fields[field])
+			case "group":
+				rule.Group, err = configValueString(fields[field])
+			case "tags":
+				tags, ok := configValueMap(fields[field])
+				if !ok {
+					err = fmt.Errorf("expected a map of tag patterns")
+					break
+				}
+				rule.Tags = map[string]string{}
+				for _, name := range sortedInterfaceKeys(tags) {
+					if rule.Tags[name], err = configValueString(tags[name]); err != nil {
+						break
+					}
+				}
+			default:
+				err = fmt.Errorf("unknown field")
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%v[%v].%v: %v", deduplicationRulesOption, i, field, err))
+			}
+		}
+		rules = append(rules, rule)
+	}
+	config.DeduplicationRules = rules
+	return problems
+}
+
+func findConfigOption(name string) (configOption, bool) {
+	for _, option := range configOptions {
+		if option.name == name {
+			return option, true
+		}
+	}
+	return configOption{}, false
+}
+
+// configValueString converts a scalar or a list of scalars of a decoded file to
+// the string the option parses, lists are joined with commas.
+func configValueString(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case int, int64, uint64, bool:
+		return fmt.Sprint(value), nil
+	case []interface{}:
+		items := []string{}
+		for _, item := range value {
+			text, err := configValueString(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, text)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unexpected value %v", value)
+	}
+}
+
+// configValueMap accepts the maps decoded from both JSON and YAML.
+func configValueMap(value interface{}) (map[string]interface{}, bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return value, true
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, item := range value {
+			converted[fmt.Sprint(key)] = item
+		}
+		return converted, true
+	default:
+		return nil, false
+	}
+}
+
+func sortedInterfaceKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ParseThreshold parses a deduplication threshold: "5%" is Percent(0.05), a plain
+// number like "0.5" is an Absolute change and "sdt:0.5" is SwingingDoor(0.5).
+func ParseThreshold(value string) (interface{}, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "sdt:") {
+		deviation, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(value, "sdt:")), 64)
+		if err != nil || deviation < 0 {
+			return nil, fmt.Errorf("invalid swinging door threshold: %q", value)
+		}
+		return SwingingDoor(deviation), nil
+	}
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64)
+		if err != nil || percent < 0 {
+			return nil, fmt.Errorf("invalid percent threshold: %q", value)
+		}
+		return Percent(percent / 100), nil
+	}
+	absolute, err := strconv.ParseFloat(value, 64)
+	if err != nil || absolute < 0 {
+		return nil, fmt.Errorf("invalid threshold: %q", value)
+	}
+	return Absolute(absolute), nil
+}
+
+var overflowPolicyNames = map[string]OverflowPolicy{
+	"drop-newest": DropNewest,
+	"drop-oldest": DropOldest,
+	"block":       Block,
+	"reject":      Reject,
+}
+
+func overflowPolicyNamesByValue() map[OverflowPolicy]string {
+	names := map[OverflowPolicy]string{}
+	for name, policy := range overflowPolicyNames {
+		names[policy] = name
+	}
+	return names
+}
+
+// ParseOverflowPolicy parses "drop-newest", "drop-oldest", "block" or "reject".
+func ParseOverflowPolicy(value string) (OverflowPolicy, error) {
+	policy, ok := overflowPolicyNames[strings.ToLower(strings.TrimSpace(value))]
+	if !ok {
+		return DropNewest, fmt.Errorf("unknown overflow policy: %q", value)
+	}
+	return policy, nil
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]ByteSize{
+		"4096":   4096,
+		"256MB":  256 << 20,
+		"1.5gb":  3 << 29,
+		"64 KiB": 64 << 10,
+		"10b":    10,
+	}
+	for value, expected := range cases {
+		if size, err := ParseByteSize(value); err != nil || size != expected {
+			t.Error(value, " unexpected result: ", size, err)
+		}
+	}
+	if _, err := ParseByteSize("many"); err == nil {
+		t.Error("invalid byte size was accepted")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yamlPath := filepath.Join(dir, "storage.yml")
+	ioutil.WriteFile(yamlPath, []byte(`
+url: tcp://atsd:8081
+failover_urls: [tcp://atsd-standby:8081, "http://atsd-standby:8088?mode=commands"]
+memstore_limit: 200000
+memstore_byte_limit: 256MB
+memstore_overflow_policy: drop-oldest
+update_interval: 30s
+group_params:
+  cpu:
+    threshold: 5%
+    interval: 5m
+  disk:
+    threshold: 0.5
+    emit_last_suppressed: true
+deduplication_rules:
+  - metric: "cpu_*"
+    group: cpu
+  - tags: {file_system: "regex:^/dev/"}
+    group: disk
+`), 0644)
+	t.Setenv("ATSD_URL", "udp://atsd:8082")
+	t.Setenv("ATSD_MEMSTORE_LIMIT", "300000")
+
+	config, err := LoadConfig(yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Url.String() != "udp://atsd:8082" || config.MemstoreLimit != 300000 {
+		t.Errorf("environment did not override the file: %v, %v", config.Url, config.MemstoreLimit)
+	}
+	if len(config.FailoverUrls) != 2 || config.FailoverUrls[1].Query().Get("mode") != "commands" {
+		t.Errorf("unexpected failover urls %v", config.FailoverUrls)
+	}
+	if config.MemstoreByteLimit != 256<<20 || config.MemstoreOverflowPolicy != DropOldest || config.UpdateInterval != 30*time.Second {
+		t.Errorf("unexpected memstore settings %v, %v, %v", config.MemstoreByteLimit, config.MemstoreOverflowPolicy, config.UpdateInterval)
+	}
+	if cpu := config.GroupParams["cpu"]; cpu.Threshold != Percent(0.05) || cpu.Interval != 5*time.Minute {
+		t.Errorf("unexpected cpu group %+v", cpu)
+	}
+	if disk := config.GroupParams["disk"]; disk.Threshold != Absolute(0.5) || !disk.EmitLastSuppressed {
+		t.Errorf("unexpected disk group %+v", disk)
+	}
+	if rules := config.DeduplicationRules; len(rules) != 2 || rules[0].Metric != "cpu_*" || rules[1].Tags["file_system"] != "regex:^/dev/" || rules[1].Group != "disk" {
+		t.Errorf("unexpected deduplication rules %+v", rules)
+	}
+
+	jsonPath := filepath.Join(dir, "storage.json")
+	ioutil.WriteFile(jsonPath, []byte(`{"memstore_limit": 20000, "sender_goroutine_limit": 0, "group_params": {"cpu": {"threshold": "high"}}, "colour": "blue"}`), 0644)
+	_, err = LoadConfig(jsonPath)
+	configError, ok := err.(*ConfigError)
+	if !ok || len(configError.Problems) != 4 || !strings.Contains(err.Error(), "unknown option colour") || !strings.Contains(err.Error(), "group_params.cpu.threshold") {
+		t.Errorf("expected the unknown option and the invalid threshold, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "SenderGoroutineLimit should be > 0") || !strings.Contains(err.Error(), "group cpu: threshold is not set") {
+		t.Errorf("expected the problems found by Validate as well, got %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := GetDefaultConfig()
+	if err := config.Validate(); err != nil {
+		t.Fatal("default config is invalid: ", err)
+	}
+
+	config.SenderGoroutineLimit = 0
+	config.MemstoreLimit = 10
+	config.GroupParams = map[string]DeduplicationParams{"cpu": {Threshold: 0.05}}
+	config.TLSCertFile = "client.pem"
+	config.DeduplicationRules = []DeduplicationRule{{Metric: "cpu_*", Group: "cpu"}, {Entity: "regex:(", Group: "disk"}}
+	config.WriteAheadLogDir = "/var/lib/collector"
+	config.SpilloverDir = "/var/lib/collector/spill"
+	socketUrl, _ := url.Parse("unixgram://")
+	config.ReplicaUrls = []*url.URL{socketUrl}
+	err := config.Validate()
+	configError, ok := err.(*ConfigError)
+	if !ok || len(configError.Problems) != 8 {
+		t.Fatalf("expected 8 problems, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "ReplicaUrls unixgram: has no socket path") {
+		t.Errorf("expected the missing socket path to be reported, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "should not be the same directory or nested") {
+		t.Errorf("expected the nested directories to be reported, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "group cpu: threshold should be Percent, Absolute or SwingingDoor, got float64") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if !strings.Contains(err.Error(), "rule 1: entity: error parsing regexp") || !strings.Contains(err.Error(), `rule 1: unknown group "disk"`) {
+		t.Errorf("expected the invalid rule to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// credentials authenticate the requests to http and https urls. A token takes
+// precedence over the username and password.
+type credentials struct {
+	username string
+	password string
+	token    string
+	// secrets are redacted from the errors and log output of the communicator the
+	// credentials belong to, see redact.
+	secrets []string
+}
+
+// minRedactedSecretLength is the length of the shortest secret redacted from
+// messages, shorter ones would also hide unrelated text. The passwords of urls
+// are redacted regardless of their length.
+const minRedactedSecretLength = 6
+
+// newCredentials reads the credentials configured by Username, PasswordFile,
+// PasswordEnv, BearerToken and BearerTokenFile.
+func newCredentials(config Config) (*credentials, error) {
+	credentials := &credentials{username: config.Username}
+	switch {
+	case config.PasswordFile != "" && config.PasswordEnv != "":
+		return nil, errors.New("PasswordFile and PasswordEnv cannot be set together")
+	case config.PasswordFile != "":
+		password, err := readSecretFile(config.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		credentials.password = password
+	case config.PasswordEnv != "":
+		password, ok := os.LookupEnv(config.PasswordEnv)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %v is not set", config.PasswordEnv)
+		}
+		credentials.password = password
+	}
+	if credentials.username == "" && (config.PasswordFile != "" || config.PasswordEnv != "") {
+		return nil, errors.New("a password is configured without Username")
+	}
+
+	switch {
+	case config.BearerToken != "" && config.BearerTokenFile != "":
+		return nil, errors.New("BearerToken and BearerTokenFile cannot be set together")
+	case config.BearerTokenFile != "":
+		token, err := readSecretFile(config.BearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		credentials.token = token
+	default:
+		credentials.token = config.BearerToken
+	}
+
+	credentials.addSecret(credentials.password)
+	credentials.addSecret(credentials.token)
+	for _, url := range append(append([]*url.URL{config.Url}, config.FailoverUrls...), config.ReplicaUrls...) {
+		if url != nil && url.User != nil {
+			password, _ := url.User.Password()
+			credentials.addSecret(password)
+		}
+	}
+	return credentials, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// authorize sets the Authorization header of the request to the url, falling
+// back to the user info of the url.
+func (self *credentials) authorize(request *nethttp.Request, url *url.URL) {
+	switch {
+	case self != nil && self.token != "":
+		request.Header.Set("Authorization", "Bearer "+self.token)
+	case self != nil && self.username != "":
+		request.SetBasicAuth(self.username, self.password)
+	case url.User != nil:
+		password, _ := url.User.Password()
+		request.SetBasicAuth(url.User.Username(), password)
+	}
+}
+
+func (self *credentials) addSecret(secret string) {
+	if len(secret) < minRedactedSecretLength {
+		return
+	}
+	for _, value := range self.secrets {
+		if value == secret {
+			return
+		}
+	}
+	self.secrets = append(self.secrets, secret)
+}
+
+var userInfoPasswordPattern = regexp.MustCompile(`(://[^/@:\s]*):[^/@\s]*@`)
+
+// redact hides the passwords of urls in the message.
+func redact(message string) string {
+	return userInfoPasswordPattern.ReplaceAllString(message, "$1:xxxxx@")
+}
+
+// redact hides the passwords of urls and the secrets of the credentials in the
+// message. It may be called on nil credentials.
+func (self *credentials) redact(message string) string {
+	message = redact(message)
+	if self == nil {
+		return message
+	}
+	for _, secret := range self.secrets {
+		message = strings.Replace(message, secret, "xxxxx", -1)
+	}
+	return message
+}
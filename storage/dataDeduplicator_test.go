@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"math"
 	"reflect"
 	"testing"
 	"time"
@@ -416,3 +417,213 @@ func TestDataCompacter(t *testing.T) {
 		}
 	}
 }
+
+func TestDataCompacterEviction(t *testing.T) {
+	now := time.Unix(0, 0)
+	dc := NewDataCompacter(map[string]DeduplicationParams{
+		"containers": {Threshold: Absolute(1), Interval: time.Hour, MaxKeys: 2, IdleTTL: time.Minute},
+	})
+	dc.now = func() time.Time { return now }
+	send := func(entity string) int {
+		return len(dc.Filter("containers", []*net.SeriesCommand{
+			net.NewSeriesCommand(entity, "cpu_busy", net.Float64(10)).SetTimestamp(net.Millis(now.UnixNano() / 1e6)),
+		}))
+	}
+
+	send("container1")
+	send("container2")
+	now = now.Add(time.Second)
+	if send("container1") != 0 {
+		t.Error("unchanged value of a kept key was sent")
+	}
+	send("container3")
+	if send("container1") != 0 || send("container2") != 1 {
+		t.Error("expected container2 to be evicted as the least recently seen key")
+	}
+
+	now = now.Add(2 * time.Minute)
+	send("container4")
+	metrics := dc.SelfMetricValues()
+	if len(metrics) != 2 || metrics[0].value.Int64() != 1 || metrics[1].value.Int64() != 4 {
+		t.Errorf("expected 1 key left after 4 evictions, got %v keys and %v evictions", metrics[0].value, metrics[1].value)
+	}
+	now = now.Add(2 * time.Minute)
+	dc.Evict()
+	if metrics := dc.SelfMetricValues(); metrics[0].value.Int64() != 0 {
+		t.Errorf("idle keys of a group no longer filtered were kept: %v", metrics[0].value)
+	}
+}
+
+func TestDataCompacterSwingingDoor(t *testing.T) {
+	const deviation = 0.5
+	dc := NewDataCompacter(map[string]DeduplicationParams{
+		"sdt": {Threshold: SwingingDoor(deviation), Interval: time.Hour},
+	})
+	input := []sample{}
+	for i := 0; i < 300; i++ {
+		var value float64
+		switch {
+		case i < 100:
+			value = float64(i) * 0.3
+		case i < 150:
+			value = 30
+		default:
+			value = 30 + 10*math.Sin(float64(i)/10) + 0.2*math.Sin(float64(i)*7)
+		}
+		input = append(input, sample{Time: net.Millis(i * 1000), Value: net.Float64(value)})
+	}
+
+	sent := []sample{}
+	for _, point := range input {
+		for _, command := range dc.Filter("sdt", []*net.SeriesCommand{
+			net.NewSeriesCommand("entity001", "temperature", point.Value).SetTimestamp(point.Time),
+		}) {
+			sent = append(sent, sample{Time: *command.Timestamp(), Value: command.Metrics()["temperature"]})
+		}
+	}
+
+	if len(sent) == 0 || sent[0] != input[0] {
+		t.Fatal("the first point was not sent: ", sent)
+	}
+	if len(sent) > len(input)/3 {
+		t.Error("the series was not compressed: ", len(sent), " of ", len(input), " points sent")
+	}
+	for i := 1; i < len(sent); i++ {
+		if sent[i].Time <= sent[i-1].Time {
+			t.Fatal("points were sent out of order: ", sent[i-1].Time, ", ", sent[i].Time)
+		}
+	}
+	segment := 0
+	for _, point := range input {
+		if point.Time > sent[len(sent)-1].Time {
+			break
+		}
+		for sent[segment+1].Time < point.Time {
+			segment++
+		}
+		from, to := sent[segment], sent[segment+1]
+		if point.Time == from.Time {
+			to = from
+		}
+		reconstructed := from.Value.Float64()
+		if to.Time != from.Time {
+			reconstructed += (to.Value.Float64() - from.Value.Float64()) * float64(point.Time-from.Time) / float64(to.Time-from.Time)
+		}
+		if math.Abs(reconstructed-point.Value.Float64()) > deviation+1e-9 {
+			t.Errorf("point at %v: reconstructed %v, expected %v within %v", point.Time, reconstructed, point.Value, deviation)
+		}
+	}
+	if sent[len(sent)-1].Time < input[len(input)-20].Time {
+		t.Error("too many points are held back: the last sent point is at ", sent[len(sent)-1].Time)
+	}
+}
+
+func TestDataCompacterSwingingDoorReleasesHeld(t *testing.T) {
+	now := time.Unix(0, 0)
+	dc := NewDataCompacter(map[string]DeduplicationParams{
+		"sdt": {Threshold: SwingingDoor(0.5), MaxKeys: 1},
+	})
+	dc.now = func() time.Time { return now }
+	send := func(entity string, ms int64, value float64) []*net.SeriesCommand {
+		return dc.Filter("sdt", []*net.SeriesCommand{
+			net.NewSeriesCommand(entity, "temperature", net.Float64(value)).SetTimestamp(net.Millis(ms)),
+		})
+	}
+	isHeld := func(commands []*net.SeriesCommand, entity string, ms int64) bool {
+		return len(commands) == 1 && commands[0].Entity() == entity && *commands[0].Timestamp() == net.Millis(ms)
+	}
+
+	send("entity001", 0, 0)
+	send("entity001", 1000, 1)
+	if output := send("entity002", 0, 0); len(output) != 2 || !isHeld(output[1:], "entity001", 1000) {
+		t.Errorf("the candidate of the evicted key was not sent: %v", output)
+	}
+
+	send("entity002", 1000, 1)
+	if output := dc.Flush(); len(output) != 0 {
+		t.Errorf("the candidate of a key seen since the previous flush was sent: %v", output)
+	}
+	now = now.Add(time.Minute)
+	if output := dc.Flush(); !isHeld(output, "entity002", 1000) {
+		t.Errorf("the candidate of a stopped series was not sent: %v", output)
+	}
+	if output := send("entity002", 2000, 2); len(output) != 0 {
+		t.Errorf("the door did not start again from the released candidate: %v", output)
+	}
+	if output := dc.flush(true); !isHeld(output, "entity002", 2000) {
+		t.Errorf("the candidate was not sent on close: %v", output)
+	}
+}
+
+func TestDataCompacterEmitLastSuppressed(t *testing.T) {
+	for _, emitLastSuppressed := range []bool{false, true} {
+		dc := NewDataCompacter(map[string]DeduplicationParams{
+			"disk": {Threshold: Absolute(1), Interval: time.Hour, EmitLastSuppressed: emitLastSuppressed},
+		})
+		sent := []sample{}
+		for i, value := range []float64{10, 10.2, 10.4, 15, 16, 15.5, 30} {
+			for _, command := range dc.Filter("disk", []*net.SeriesCommand{
+				net.NewSeriesCommand("entity001", "disk_used", net.Float64(value)).SetTimestamp(net.Millis(i * 1000)),
+			}) {
+				sent = append(sent, sample{Time: *command.Timestamp(), Value: command.Metrics()["disk_used"]})
+			}
+		}
+
+		expected := []sample{{0, net.Float64(10)}, {3000, net.Float64(15)}, {6000, net.Float64(30)}}
+		if emitLastSuppressed {
+			expected = []sample{{0, net.Float64(10)}, {2000, net.Float64(10.4)}, {3000, net.Float64(15)},
+				{5000, net.Float64(15.5)}, {6000, net.Float64(30)}}
+		}
+		if !reflect.DeepEqual(sent, expected) {
+			t.Errorf("EmitLastSuppressed = %v: expected %v, got %v", emitLastSuppressed, expected, sent)
+		}
+	}
+}
+
+func TestDataCompacterRules(t *testing.T) {
+	dc := NewDataCompacter(map[string]DeduplicationParams{
+		"cpu":  {Threshold: Absolute(1), Interval: time.Hour},
+		"disk": {Threshold: Absolute(10), Interval: time.Hour},
+	})
+	err := dc.SetRules([]DeduplicationRule{
+		{Metric: "cpu_*", Group: "cpu"},
+		{Tags: map[string]string{"file_system": "regex:^/dev/"}, Group: "disk"},
+		{Entity: "nurswgvml00?", Group: "cpu"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(group string, command *net.SeriesCommand) map[string]net.Number {
+		metrics := map[string]net.Number{}
+		for _, command := range dc.Filter(group, []*net.SeriesCommand{command}) {
+			for metric, value := range command.Metrics() {
+				metrics[metric] = value
+			}
+		}
+		return metrics
+	}
+	disk := func(value float64, timestamp net.Millis) *net.SeriesCommand {
+		return net.NewSeriesCommand("nurswgvml007", "disk_used", net.Float64(value)).SetTag("file_system", "/dev/sda1").SetTimestamp(timestamp)
+	}
+
+	server := func(cpu float64, timestamp net.Millis) *net.SeriesCommand {
+		command := net.NewSeriesCommand("server001", "cpu_busy", net.Float64(cpu)).SetTimestamp(timestamp)
+		command.SetMetricValue("memory_used", net.Float64(5))
+		return command
+	}
+
+	send("", server(10, 0))
+	if metrics := send("", server(10.5, 1000)); !reflect.DeepEqual(metrics, map[string]net.Number{"memory_used": net.Float64(5)}) {
+		t.Error("expected cpu_busy to be filtered by the cpu rule and memory_used to match no rule, got ", metrics)
+	}
+
+	send("", disk(100, 0))
+	if metrics := send("", disk(105, 1000)); len(metrics) != 0 {
+		t.Error("expected the tag rule to take precedence over the entity rule, got ", metrics)
+	}
+
+	send("cpu", disk(100, 2000))
+	if metrics := send("cpu", disk(102, 3000)); len(metrics) != 1 {
+		t.Error("expected the explicit group to take precedence over the rules, got ", metrics)
+	}
+}
@@ -0,0 +1,349 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+var (
+	errCloseDeadline = errors.New("not delivered before the Close deadline")
+	errQueueFull     = errors.New("destination queue is full")
+)
+
+// DeadLetterSink stores the commands that the communicators give up on, see
+// Config.DeadLetterFile. Storage closes its sink in Storage.Close, including a
+// Config.DeadLetterHandler that is a DeadLetterSink.
+type DeadLetterSink interface {
+	DeadLetterHandler
+	Close() error
+}
+
+// journal tells the commands dropped at the Close deadline that are still kept
+// on disk, by the write-ahead log or the spillover, and delivered after a restart.
+// Dead-lettering those as well would deliver them twice.
+type journal struct {
+	// walAttached is set if every released command stays in the write-ahead log until delivered.
+	walAttached bool
+	spillover   *Spillover
+	// metadataCompacter, if set, is told about the rejected commands so that it
+	// does not record them as delivered.
+	metadataCompacter *MetadataCompacter
+}
+
+// filter wraps handler to skip the journaled commands, see journaledFilter, and
+// to tell the metadata compacter about the rejected ones, see metadataDeadLetters.
+func (self journal) filter(handler DeadLetterHandler) DeadLetterHandler {
+	if handler != nil && (self.walAttached || self.spillover != nil) {
+		handler = &journaledFilter{handler: handler, journal: self}
+	}
+	if self.metadataCompacter != nil {
+		handler = &metadataDeadLetters{handler: handler, metadataCompacter: self.metadataCompacter}
+	}
+	return handler
+}
+
+func (self journal) isJournaled(command fmt.Stringer) bool {
+	return self.walAttached || (self.spillover != nil && self.spillover.isRequeued(command))
+}
+
+// journaledFilter passes the dead letters on to handler, except for the journaled
+// commands dropped at the Close deadline.
+type journaledFilter struct {
+	handler DeadLetterHandler
+	journal journal
+}
+
+func (self *journaledFilter) OnRejected(commandType string, commands []fmt.Stringer, err error) {
+	if errors.Is(err, errCloseDeadline) {
+		unjournaled := []fmt.Stringer{}
+		for _, command := range commands {
+			if !self.journal.isJournaled(command) {
+				unjournaled = append(unjournaled, command)
+			}
+		}
+		if len(unjournaled) == 0 {
+			return
+		}
+		commands = unjournaled
+	}
+	self.handler.OnRejected(commandType, commands, err)
+}
+
+// Close closes handler if it is a DeadLetterSink.
+func (self *journaledFilter) Close() error {
+	if sink, ok := self.handler.(DeadLetterSink); ok {
+		return sink.Close()
+	}
+	return nil
+}
+
+// metadataDeadLetters tells metadataCompacter about the dead letters and passes
+// them on to handler. Without a handler it logs the rejected commands like the
+// communicators do, and nothing for the dropped ones.
+type metadataDeadLetters struct {
+	handler           DeadLetterHandler
+	metadataCompacter *MetadataCompacter
+}
+
+func (self *metadataDeadLetters) OnRejected(commandType string, commands []fmt.Stringer, err error) {
+	self.metadataCompacter.onRejected(commandType, commands)
+	switch {
+	case self.handler != nil:
+		self.handler.OnRejected(commandType, commands, err)
+	case !errors.Is(err, errCloseDeadline) && !errors.Is(err, errQueueFull):
+		for _, command := range commands {
+			logger.Warning("Dropping rejected command ", command, ": ", err)
+		}
+	}
+}
+
+// isSameHandler reports whether a and b are the same handler, so that replacing
+// one with the other must not close it.
+func isSameHandler(a, b DeadLetterHandler) bool {
+	if a == nil || b == nil || reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// FileDeadLetterSink appends dead letters to a file as network commands, each group
+// of commands preceded by a "#" comment line with the time, the command type and
+// the reason they were not delivered:
+//
+//	# 2016-01-02T15:04:05Z property 400 Bad Request
+//	property e:nurswgvml007 t:disk k:id=sda v:size=100
+//
+// Storage.ReinjectDeadLetters queues the commands of such a file again.
+type FileDeadLetterSink struct {
+	file   *os.File
+	writer *bufio.Writer
+	mutex  sync.Mutex
+}
+
+// OpenFileDeadLetterSink opens the file for appending, creating it if needed.
+func OpenFileDeadLetterSink(path string) (*FileDeadLetterSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterSink{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (self *FileDeadLetterSink) OnRejected(commandType string, commands []fmt.Stringer, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	reason := strings.Replace(err.Error(), "\n", " ", -1)
+	fmt.Fprintf(self.writer, "# %v %v %v\n", time.Now().UTC().Format(time.RFC3339), commandType, reason)
+	for _, command := range commands {
+		self.writer.WriteString(strings.TrimSuffix(command.String(), "\n") + "\n")
+	}
+	if err := self.writer.Flush(); err != nil {
+		logger.Error("Could not write dead letters to ", self.file.Name(), ": ", err)
+	}
+}
+
+func (self *FileDeadLetterSink) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if err := self.writer.Flush(); err != nil {
+		self.file.Close()
+		return err
+	}
+	return self.file.Close()
+}
+
+// ReadDeadLetters parses a file written by FileDeadLetterSink. Comment and empty
+// lines are skipped, any other line that is not a valid command is an error.
+func ReadDeadLetters(path string) (*Batch, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	batch := &Batch{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		record, err := parseNetworkCommand(line)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, lineNumber, err)
+		}
+		command, err := record.command()
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, lineNumber, err)
+		}
+		switch command := command.(type) {
+		case *net.SeriesCommand:
+			batch.SeriesCommands = append(batch.SeriesCommands, command)
+		case *net.PropertyCommand:
+			batch.PropertyCommands = append(batch.PropertyCommands, command)
+		case *net.EntityTagCommand:
+			batch.EntityTagCommands = append(batch.EntityTagCommands, command)
+		case *net.MessageCommand:
+			batch.MessageCommands = append(batch.MessageCommands, command)
+		}
+	}
+	return batch, scanner.Err()
+}
+
+// parseNetworkCommand parses one series, property, entity or message network
+// command into a logRecord. Names and values containing spaces, "=" or quotes are
+// double-quoted with inner quotes doubled.
+func parseNetworkCommand(line string) (*logRecord, error) {
+	tokenizer := &commandTokenizer{line: line}
+	record := &logRecord{Command: tokenizer.word()}
+	switch record.Command {
+	case "series", "property", "entity", "message":
+	default:
+		return nil, fmt.Errorf("unknown command: %q", record.Command)
+	}
+	for tokenizer.skipSpaces() {
+		field, name, value, isPair, err := tokenizer.field()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case field == "e" && !isPair:
+			record.Entity = value
+		case field == "ms" && !isPair:
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ms: %q", value)
+			}
+			timestamp := net.Millis(ms)
+			record.Timestamp = &timestamp
+		case field == "t" && !isPair && record.Command == "property":
+			record.PropType = value
+		case field == "t" && isPair && record.Command != "property",
+			field == "v" && isPair && record.Command == "property":
+			if record.Tags == nil {
+				record.Tags = map[string]string{}
+			}
+			record.Tags[name] = value
+		case field == "k" && isPair && record.Command == "property":
+			if record.Key == nil {
+				record.Key = map[string]string{}
+			}
+			record.Key[name] = value
+		case field == "m" && isPair && record.Command == "series":
+			if record.Metrics == nil {
+				record.Metrics = map[string]logNumber{}
+			}
+			number, err := parseLogNumber(value)
+			if err != nil {
+				return nil, err
+			}
+			record.Metrics[name] = number
+		case field == "m" && !isPair && record.Command == "message":
+			record.Message = value
+		default:
+			return nil, fmt.Errorf("unexpected field %q in %v command", field, record.Command)
+		}
+	}
+	if record.Entity == "" {
+		return nil, fmt.Errorf("%v command without entity", record.Command)
+	}
+	return record, nil
+}
+
+func parseLogNumber(value string) (logNumber, error) {
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return logNumber{Type: "int64", Value: value}, nil
+	}
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return logNumber{}, fmt.Errorf("invalid metric value: %q", value)
+	}
+	return logNumber{Type: "float64", Value: value}, nil
+}
+
+type commandTokenizer struct {
+	line     string
+	position int
+}
+
+func (self *commandTokenizer) skipSpaces() bool {
+	for self.position < len(self.line) && self.line[self.position] == ' ' {
+		self.position++
+	}
+	return self.position < len(self.line)
+}
+
+func (self *commandTokenizer) word() string {
+	start := self.position
+	for self.position < len(self.line) && self.line[self.position] != ' ' {
+		self.position++
+	}
+	return self.line[start:self.position]
+}
+
+// field reads a "field:value" or "field:name=value" token.
+func (self *commandTokenizer) field() (field, name, value string, isPair bool, err error) {
+	colon := strings.IndexByte(self.line[self.position:], ':')
+	if colon < 0 {
+		return "", "", "", false, fmt.Errorf("expected field at %q", self.line[self.position:])
+	}
+	field = self.line[self.position : self.position+colon]
+	self.position += colon + 1
+	if value, err = self.value(); err != nil {
+		return
+	}
+	if self.position < len(self.line) && self.line[self.position] == '=' {
+		self.position++
+		name = value
+		isPair = true
+		value, err = self.value()
+	}
+	return
+}
+
+func (self *commandTokenizer) value() (string, error) {
+	if self.position >= len(self.line) || self.line[self.position] != '"' {
+		start := self.position
+		for self.position < len(self.line) && self.line[self.position] != ' ' && self.line[self.position] != '=' {
+			self.position++
+		}
+		return self.line[start:self.position], nil
+	}
+	value := []byte{}
+	for self.position++; self.position < len(self.line); self.position++ {
+		if self.line[self.position] != '"' {
+			value = append(value, self.line[self.position])
+		} else if self.position+1 < len(self.line) && self.line[self.position+1] == '"' {
+			value = append(value, '"')
+			self.position++
+		} else {
+			self.position++
+			return string(value), nil
+		}
+	}
+	return "", fmt.Errorf("unterminated quote in %q", self.line)
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+func TestFileDeadLetterSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead-letters.txt")
+
+	sink, err := OpenFileDeadLetterSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := []fmt.Stringer{
+		net.NewSeriesCommand("entity 1", "cpu_busy", net.Float64(12.5)).SetTag("host", "a=b").SetTimestamp(1000),
+		net.NewPropertyCommand("disk", "entity1", "size", "100").SetKey("id", `say "sda"`).SetTimestamp(2000),
+		net.NewEntityTagCommand("entity1", "location", "dc 1"),
+		net.NewMessageCommand("entity1", "disk is full").SetTag("severity", "WARNING").SetTimestamp(3000),
+	}
+	sink.OnRejected(PropertyCommandType, commands[:2], errors.New("400 Bad Request\ninvalid entity"))
+	sink.OnRejected(MessageCommandType, commands[2:], errCloseDeadline)
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 6 || !strings.HasPrefix(lines[0], "# ") || !strings.HasSuffix(lines[0], " property 400 Bad Request invalid entity") {
+		t.Fatalf("unexpected dead-letter file:\n%s", content)
+	}
+
+	batch, err := ReadDeadLetters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := []fmt.Stringer{batch.SeriesCommands[0], batch.PropertyCommands[0], batch.EntityTagCommands[0], batch.MessageCommands[0]}
+	for i := range commands {
+		if read[i].String() != commands[i].String() {
+			t.Errorf("expected %q, got %q", commands[i].String(), read[i].String())
+		}
+	}
+
+	config := GetDefaultConfig()
+	memstore, _ := NewMemStore(minMemoryLimit)
+	storage, err := newStorage(config, memstore, &fakeCommunicator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted, err := storage.ReinjectDeadLetters(path); err != nil || accepted != 4 {
+		t.Errorf("expected 4 reinjected commands, got %v, %v", accepted, err)
+	}
+}
+
+func TestReadDeadLettersInvalidCommand(t *testing.T) {
+	file, err := ioutil.TempFile("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# comment\nseries e:entity1 m:cpu=1\nseries e:entity1 m:cpu=high\n")
+	file.Close()
+
+	if _, err := ReadDeadLetters(file.Name()); err == nil || !strings.Contains(err.Error(), ":3: invalid metric value") {
+		t.Errorf("expected an invalid metric value error on line 3, got %v", err)
+	}
+}
+
+// closingDeadLetters is a DeadLetterSink that records whether it was closed.
+type closingDeadLetters struct {
+	recordingDeadLetters
+	closed bool
+}
+
+func (self *closingDeadLetters) Close() error {
+	self.closed = true
+	return nil
+}
+
+func TestStorageCloseDeadlineSkipsJournaledDeadLetters(t *testing.T) {
+	listener, _ := listenCommands(t)
+	address := listener.Addr().String()
+	listener.Close()
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, walDir := range []string{"", dir} {
+		config := GetDefaultConfig()
+		config.Url = &url.URL{Scheme: "tcp", Host: address}
+		config.WriteAheadLogDir = walDir
+		deadLetters := &closingDeadLetters{}
+		config.DeadLetterHandler = deadLetters
+		storage, err := NewFactoryFromConfig(config).Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The sender gets stuck on the first message, the second one is dropped from the queue.
+		storage.QueuedSendMessageCommands([]*net.MessageCommand{net.NewMessageCommand("entity001", "message001")})
+		storage.ForceSend()
+		storage.QueuedSendMessageCommands([]*net.MessageCommand{net.NewMessageCommand("entity001", "message002")})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		err = storage.Close(ctx)
+		cancel()
+		if undelivered, ok := err.(*UndeliveredError); !ok || undelivered.MessageCommands != 2 {
+			t.Error("unexpected error: ", err)
+		}
+		if !deadLetters.closed {
+			t.Error("the configured sink was not closed")
+		}
+		deadLetters.mutex.Lock()
+		rejected := len(deadLetters.rejected)
+		deadLetters.mutex.Unlock()
+		if walDir == "" && rejected != 1 {
+			t.Error("the dropped message was not dead-lettered: ", rejected)
+		}
+		if walDir != "" && rejected != 0 {
+			t.Error("the message kept in the write-ahead log was dead-lettered too: ", rejected)
+		}
+	}
+}
+
+func TestStorageSetDeadLetterSink(t *testing.T) {
+	config := GetDefaultConfig()
+	configured := &closingDeadLetters{}
+	config.DeadLetterHandler = configured
+	memstore, _ := NewMemStore(minMemoryLimit)
+	storage, err := newStorage(config, memstore, &fakeCommunicator{connected: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replacement := &closingDeadLetters{}
+	if err := storage.SetDeadLetterSink(replacement); err != nil {
+		t.Fatal(err)
+	}
+	if !configured.closed || replacement.closed {
+		t.Error("the replaced sink was not closed")
+	}
+	storage.listeners.rejectCommands(SeriesCommandType, []fmt.Stringer{testCommand(1)}, errors.New("invalid"))
+	if len(replacement.rejected) != 1 || len(configured.rejected) != 0 {
+		t.Error("dead letters did not reach the new sink")
+	}
+
+	reconfigured := config
+	reconfigured.UpdateInterval = 2 * config.UpdateInterval
+	reconfigured.Url, _ = url.Parse("tcp://atsd-2:8081")
+	storage.newTransport = func(config Config) (transport, error) {
+		return &fakeCommunicator{connected: true}, nil
+	}
+	if err := storage.Reconfigure(context.Background(), reconfigured, true); err != nil {
+		t.Fatal(err)
+	}
+	storage.listeners.rejectCommands(SeriesCommandType, []fmt.Stringer{testCommand(2)}, errors.New("invalid"))
+	if replacement.closed || len(replacement.rejected) != 2 {
+		t.Error("Reconfigure dropped the sink set at runtime")
+	}
+	if err := storage.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !replacement.closed {
+		t.Error("the sink was not closed by Close")
+	}
+}
@@ -0,0 +1,135 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DeduplicationRule applies the deduplication params of a group to the series
+// that match it, see Config.DeduplicationRules. Metric, Entity and the values of
+// Tags are glob patterns where "*" matches any text and "?" a single character,
+// or regular expressions when prefixed with "regex:". An empty pattern matches
+// anything, a listed tag has to be present.
+type DeduplicationRule struct {
+	Metric string
+	Entity string
+	Tags   map[string]string
+	// Group is the GroupParams entry used for the matching series.
+	Group string
+}
+
+type compiledRule struct {
+	metric *regexp.Regexp
+	entity *regexp.Regexp
+	tags   map[string]*regexp.Regexp
+	group  string
+}
+
+func compileRules(rules []DeduplicationRule) ([]compiledRule, error) {
+	compiled := make([]compiledRule, 0, len(rules))
+	for i, rule := range rules {
+		compiledRule := compiledRule{tags: map[string]*regexp.Regexp{}, group: rule.Group}
+		var err error
+		if compiledRule.metric, err = compilePattern(rule.Metric); err != nil {
+			return nil, fmt.Errorf("rule %v: metric: %v", i, err)
+		}
+		if compiledRule.entity, err = compilePattern(rule.Entity); err != nil {
+			return nil, fmt.Errorf("rule %v: entity: %v", i, err)
+		}
+		for _, name := range sortedTagNames(rule.Tags) {
+			if compiledRule.tags[name], err = compilePattern(rule.Tags[name]); err != nil {
+				return nil, fmt.Errorf("rule %v: tag %v: %v", i, name, err)
+			}
+		}
+		compiled = append(compiled, compiledRule)
+	}
+	return compiled, nil
+}
+
+// compilePattern returns nil for the empty pattern.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(pattern, "regex:") {
+		return regexp.Compile(strings.TrimPrefix(pattern, "regex:"))
+	}
+	expression := ""
+	for _, char := range pattern {
+		switch char {
+		case '*':
+			expression += ".*"
+		case '?':
+			expression += "."
+		default:
+			expression += regexp.QuoteMeta(string(char))
+		}
+	}
+	return regexp.Compile("^" + expression + "$")
+}
+
+func (self compiledRule) matches(entity, metric string, tags map[string]string) bool {
+	if self.metric != nil && !self.metric.MatchString(metric) {
+		return false
+	}
+	if self.entity != nil && !self.entity.MatchString(entity) {
+		return false
+	}
+	for name, pattern := range self.tags {
+		value, ok := tags[name]
+		if !ok || (pattern != nil && !pattern.MatchString(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRules returns the group of the first rule matching the series.
+func matchRules(rules []compiledRule, entity, metric string, tags map[string]string) (string, bool) {
+	for _, rule := range rules {
+		if rule.matches(entity, metric, tags) {
+			return rule.group, true
+		}
+	}
+	return "", false
+}
+
+// validateRules returns the problems of the rules for Config.Validate.
+func validateRules(rules []DeduplicationRule, groupParams map[string]DeduplicationParams) []string {
+	problems := []string{}
+	if _, err := compileRules(rules); err != nil {
+		problems = append(problems, "DeduplicationRules: "+err.Error())
+	}
+	for i, rule := range rules {
+		if _, ok := groupParams[rule.Group]; !ok {
+			problems = append(problems, fmt.Sprintf("DeduplicationRules: rule %v: unknown group %q", i, rule.Group))
+		}
+	}
+	return problems
+}
+
+func sortedTagNames(tags map[string]string) []string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
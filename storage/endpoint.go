@@ -0,0 +1,224 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	commandApiPath     = "/api/v1/command"
+	commandPostTimeout = 1 * time.Minute
+	// commandPostSize is the uncompressed size of the commands posted in one request.
+	commandPostSize = 1 << 20
+)
+
+// endpoint is one destination of a NetworkCommunicator. tcp, tls, udp, unix and
+// unixgram endpoints receive the commands over a socket, http and https endpoints receive them as
+// the body of requests to the ATSD command API.
+type endpoint struct {
+	url     *url.URL
+	network string
+	address string
+	// tlsConfig is set for tls endpoints.
+	tlsConfig *tls.Config
+	client    *nethttp.Client
+	// credentials authenticate the requests of http endpoints.
+	credentials *credentials
+}
+
+func newEndpoint(url *url.URL, tlsConfig *tls.Config, credentials *credentials) (*endpoint, error) {
+	switch url.Scheme {
+	case "tcp", "udp":
+		return &endpoint{url: url, network: url.Scheme, address: withDefaultPort(url)}, nil
+	case "unix", "unixgram":
+		// unix:///path/to/socket, the path is taken as is without a default port.
+		return &endpoint{url: url, network: url.Scheme, address: url.Host + url.Path}, nil
+	case "tls", "tcp+tls":
+		return &endpoint{url: url, network: "tcp", address: withDefaultPort(url), tlsConfig: tlsConfig}, nil
+	case "http", "https":
+		transport := &nethttp.Transport{TLSClientConfig: tlsConfig}
+		client := &nethttp.Client{Transport: transport, Timeout: commandPostTimeout}
+		return &endpoint{url: url, address: url.Host, client: client, credentials: credentials}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported protocol: %v", url.Scheme))
+	}
+}
+
+func withDefaultPort(url *url.URL) string {
+	if strings.Contains(url.Host, ":") {
+		return url.Host
+	}
+	if url.Scheme == "udp" {
+		return url.Host + ":8082"
+	}
+	return url.Host + ":8081"
+}
+
+// newTLSConfig builds the client TLS settings of tls and https endpoints from the config.
+func newTLSConfig(config Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify, ServerName: config.TLSServerName}
+	if config.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(config.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("no certificates found in %v", config.TLSCAFile))
+		}
+	}
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+func (self *endpoint) String() string {
+	return self.address
+}
+
+// isConnectionless reports whether the endpoint is a datagram socket: dialing it
+// succeeds without reaching ATSD and every write is sent as one datagram.
+func (self *endpoint) isConnectionless() bool {
+	return self.network == "udp" || self.network == "unixgram"
+}
+
+// bufferLimit is the number of buffered bytes after which the commands are written out.
+func (self *endpoint) bufferLimit() int {
+	if self.client != nil {
+		return commandPostSize
+	}
+	return bufferSize
+}
+
+// dial opens a connection to the endpoint. For http endpoints it only checks that
+// ATSD responds, every write to the returned connection is a separate request
+// made with ctx.
+func (self *endpoint) dial(ctx context.Context, timeout time.Duration) (io.WriteCloser, error) {
+	if self.tlsConfig != nil {
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: timeout}, Config: self.tlsConfig}
+		return dialer.DialContext(ctx, self.network, self.address)
+	}
+	if self.client == nil {
+		dialer := &net.Dialer{Timeout: timeout}
+		return dialer.DialContext(ctx, self.network, self.address)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	request, err := nethttp.NewRequest("GET", self.baseUrl(), nil)
+	if err != nil {
+		return nil, err
+	}
+	self.credentials.authorize(request, self.url)
+	response, err := self.client.Do(request.WithContext(dialCtx))
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	return &commandPoster{endpoint: self, ctx: ctx}, nil
+}
+
+// open is dial without the request checking that an http endpoint responds, for
+// connections written to once, where the write itself tells.
+func (self *endpoint) open(ctx context.Context, timeout time.Duration) (io.WriteCloser, error) {
+	if self.client != nil {
+		return &commandPoster{endpoint: self, ctx: ctx}, nil
+	}
+	return self.dial(ctx, timeout)
+}
+
+func (self *endpoint) baseUrl() string {
+	return apiBaseUrl(self.url)
+}
+
+// apiBaseUrl returns the url without credentials, query and trailing slash, the
+// paths of the ATSD API are appended to it.
+func apiBaseUrl(url *url.URL) string {
+	base := *url
+	base.User = nil
+	base.RawQuery = ""
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	return base.String()
+}
+
+// commandPoster posts every write to the ATSD command API as gzip-compressed plain text.
+type commandPoster struct {
+	endpoint *endpoint
+	ctx      context.Context
+}
+
+func (self *commandPoster) Write(commands []byte) (int, error) {
+	if len(commands) == 0 {
+		return 0, nil
+	}
+	body := &bytes.Buffer{}
+	writer := gzip.NewWriter(body)
+	if _, err := writer.Write(commands); err != nil {
+		return 0, err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+	request, err := nethttp.NewRequest("POST", self.endpoint.baseUrl()+commandApiPath, body)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "text/plain")
+	request.Header.Set("Content-Encoding", "gzip")
+	self.endpoint.credentials.authorize(request, self.endpoint.url)
+	response, err := self.endpoint.client.Do(request.WithContext(self.ctx))
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return 0, &StatusError{Code: response.StatusCode, Status: response.Status, Request: "POST " + commandApiPath}
+	}
+	return len(commands), nil
+}
+
+func (self *commandPoster) Close() error {
+	return nil
+}
+
+// setWriteDeadline sets the deadline of socket connections, other connections are left as they are.
+func setWriteDeadline(conn io.WriteCloser, deadline time.Time) {
+	if conn, ok := conn.(interface {
+		SetWriteDeadline(time.Time) error
+	}); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+}
@@ -16,10 +16,12 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"time"
-
-	"github.com/axibase/atsd-api-go/http"
 )
 
 type StorageFactory interface {
@@ -27,13 +29,7 @@ type StorageFactory interface {
 }
 
 type NetworkStorageFactory struct {
-	selfMetricsEntity    string
-	url                  *url.URL
-	metricPrefix         string
-	memstoreLimit        uint
-	senderGoroutineLimit int
-	updateInterval       time.Duration
-	groupParams          map[string]DeduplicationParams
+	config Config
 }
 
 func NewNetworkStorageFactory(
@@ -45,40 +41,60 @@ func NewNetworkStorageFactory(
 	metricPrefix string,
 	groupParams map[string]DeduplicationParams,
 ) *NetworkStorageFactory {
-	return &NetworkStorageFactory{
-		selfMetricsEntity:    selfMetricsEntity,
-		memstoreLimit:        memstoreLimit,
-		url:                  url,
-		senderGoroutineLimit: senderGoroutineLimit,
-		updateInterval:       updateInterval,
-		metricPrefix:         metricPrefix,
-		groupParams:          groupParams,
-	}
+	config := GetDefaultConfig()
+	config.SelfMetricEntity = selfMetricsEntity
+	config.Url = url
+	config.MemstoreLimit = memstoreLimit
+	config.SenderGoroutineLimit = senderGoroutineLimit
+	config.UpdateInterval = updateInterval
+	config.MetricPrefix = metricPrefix
+	config.GroupParams = groupParams
+	return &NetworkStorageFactory{config: config}
 }
 
 func (self *NetworkStorageFactory) Create() (*Storage, error) {
-	memstore, err := NewMemStore(self.memstoreLimit)
+	return createStorage(self.config, newNetworkTransport)
+}
+
+// createStorage validates the config and creates the Storage with the transport
+// built by newTransport. If that fails, the write-ahead log opened for the
+// memstore is closed again, so that the directory can be opened by a retry.
+func createStorage(config Config, newTransport func(config Config) (transport, error)) (*Storage, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	memstore, err := newMemStoreFromConfig(config)
 	if err != nil {
 		return nil, err
 	}
-	writeCommunicator, err := NewNetworkCommunicator(self.senderGoroutineLimit, self.url)
+	created := false
+	defer func() {
+		if wal := memstore.WriteAheadLog(); wal != nil && !created {
+			wal.Close()
+		}
+	}()
+	writeCommunicator, err := newTransport(config)
 	if err != nil {
 		return nil, err
 	}
-	storage := &Storage{
-		selfMetricsEntity:      self.selfMetricsEntity,
-		memstore:               memstore,
-		dataCompacter:          NewDataCompacter(self.groupParams),
-		writeCommunicator:      writeCommunicator,
-		updateInterval:         self.updateInterval,
-		selfMetricSendInterval: 15 * time.Second,
-		isUpdating:             false,
-		metricPrefix:           self.metricPrefix,
+	storage, err := newStorage(config, memstore, writeCommunicator)
+	if err != nil {
+		return nil, err
 	}
-
+	storage.newTransport = newTransport
+	created = true
 	return storage, nil
 }
 
+// newNetworkTransport creates the network communicator for config.Url and its replicas.
+func newNetworkTransport(config Config) (transport, error) {
+	writeCommunicator, err := newNetworkCommunicator(config)
+	if err != nil {
+		return nil, err
+	}
+	return withReplicas(config, writeCommunicator)
+}
+
 func NewHttpStorageFactory(
 	selfMetricsEntity string,
 	url *url.URL,
@@ -88,79 +104,234 @@ func NewHttpStorageFactory(
 	metricPrefix string,
 	groupParams map[string]DeduplicationParams,
 ) *HttpStorageFactory {
-	return &HttpStorageFactory{
-		selfMetricsEntity:  selfMetricsEntity,
-		memstoreLimit:      memstoreLimit,
-		url:                url,
-		insecureSkipVerify: insecureSkipVerify,
-		updateInterval:     updateInterval,
-		metricPrefix:       metricPrefix,
-		groupParams:        groupParams,
-	}
+	config := GetDefaultConfig()
+	config.SelfMetricEntity = selfMetricsEntity
+	config.Url = url
+	config.InsecureSkipVerify = insecureSkipVerify
+	config.MemstoreLimit = memstoreLimit
+	config.UpdateInterval = updateInterval
+	config.MetricPrefix = metricPrefix
+	config.GroupParams = groupParams
+	return &HttpStorageFactory{config: config}
 }
 
 type HttpStorageFactory struct {
-	selfMetricsEntity string
-	memstoreLimit     uint
-
-	url                *url.URL
-	insecureSkipVerify bool
-	updateInterval     time.Duration
-	metricPrefix       string
-	groupParams        map[string]DeduplicationParams
+	config Config
 }
 
 func (self *HttpStorageFactory) Create() (*Storage, error) {
-	memstore, err := NewMemStore(self.memstoreLimit)
+	return createStorage(self.config, newHttpTransport)
+}
+
+// newHttpTransport creates the http communicator for config.Url and its replicas.
+func newHttpTransport(config Config) (transport, error) {
+	writeCommunicator, err := newHttpWriteCommunicator(config, config.Url)
+	if err != nil {
+		return nil, err
+	}
+	return withReplicas(config, writeCommunicator)
+}
+
+// newWriteCommunicator creates the communicator for one destination, picking the transport by the url.
+func newWriteCommunicator(config Config, url *url.URL) (transport, error) {
+	if !isNetworkUrl(url) {
+		return newHttpWriteCommunicator(config, url)
+	}
+	config.Url = url
+	config.FailoverUrls = nil
+	writeCommunicator, err := newNetworkCommunicator(config)
+	if err != nil {
+		return nil, err
+	}
+	return writeCommunicator, nil
+}
+
+// newHttpWriteCommunicator creates the communicator for a url served by the REST API.
+func newHttpWriteCommunicator(config Config, url *url.URL) (*HttpCommunicator, error) {
+	client, err := newHttpApiClient(config, url)
+	if err != nil {
+		return nil, err
+	}
+	return newHttpCommunicator(client, config.SenderGoroutineLimit, config.HttpMaxBatchSize), nil
+}
+
+// isNetworkUrl reports whether the url is served by the network communicator: socket
+// urls and http urls with the mode=commands query parameter, which post network
+// commands to the ATSD command API instead of calling the REST API for each command type.
+func isNetworkUrl(url *url.URL) bool {
+	switch url.Scheme {
+	case "udp", "tcp", "tls", "tcp+tls", "unix", "unixgram":
+		return true
+	case "http", "https":
+		return url.Query().Get("mode") == "commands"
+	default:
+		return false
+	}
+}
+
+// withReplicas returns a FanOutCommunicator sending to the primary communicator
+// and to every config.ReplicaUrls destination, or primary itself if there are none.
+// With config.SpilloverDir set, every destination spills to its own subdirectory.
+func withReplicas(config Config, primary transport) (transport, error) {
+	if len(config.ReplicaUrls) == 0 {
+		return primary, nil
+	}
+	urls := append([]*url.URL{config.Url}, config.ReplicaUrls...)
+	names := []string{}
+	communicators := []transport{primary}
+	closeAll := func() {
+		for _, communicator := range communicators {
+			communicator.Close(context.Background())
+		}
+	}
+	for i, url := range urls {
+		names = append(names, url.Host)
+		if i == 0 {
+			continue
+		}
+		writeCommunicator, err := newWriteCommunicator(config, url)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		communicators = append(communicators, writeCommunicator)
+	}
+
+	var spillovers []*Spillover
+	if config.SpilloverDir != "" {
+		for _, url := range urls {
+			dir := filepath.Join(config.SpilloverDir, destinationDirName(url))
+			spillover, err := OpenSpillover(dir, config.SpilloverMaxSize, config.SpilloverMaxAge)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			spillovers = append(spillovers, spillover)
+		}
+	}
+	return newFanOutCommunicator(names, communicators, spillovers, config.UpdateInterval)
+}
+
+// destinationDirName returns the name of the spillover subdirectory of a destination.
+func destinationDirName(url *url.URL) string {
+	return "destination-" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, url.Host+url.Path)
+}
+
+func newMemStoreFromConfig(config Config) (*MemStore, error) {
+	memstore, err := NewMemStore(config.MemstoreLimit)
+	if err != nil {
+		return nil, err
+	}
+	memstore.ByteLimit = uint64(config.MemstoreByteLimit)
+	memstore.Quotas = config.MemstoreQuotas
+	memstore.OverflowPolicy = config.MemstoreOverflowPolicy
+	memstore.BlockTimeout = config.MemstoreBlockTimeout
+	if config.WriteAheadLogDir != "" {
+		wal, err := OpenWriteAheadLog(config.WriteAheadLogDir)
+		if err != nil {
+			return nil, err
+		}
+		memstore.AttachWriteAheadLog(wal)
+	}
+	return memstore, nil
+}
+
+func newStorage(config Config, memstore *MemStore, writeCommunicator transport) (*Storage, error) {
+	dataCompacter := NewDataCompacter(config.GroupParams)
+	if err := dataCompacter.SetRules(config.DeduplicationRules); err != nil {
+		writeCommunicator.Close(context.Background())
+		return nil, err
+	}
+	var spillover *Spillover
+	if config.SpilloverDir != "" {
+		var err error
+		spillover, err = OpenSpillover(config.SpilloverDir, config.SpilloverMaxSize, config.SpilloverMaxAge)
+		if err != nil {
+			writeCommunicator.Close(context.Background())
+			return nil, err
+		}
+	}
+	metadataCompacter := NewMetadataCompacter(config.MetadataRefreshInterval)
+	journal := journal{walAttached: memstore.WriteAheadLog() != nil, spillover: spillover, metadataCompacter: metadataCompacter}
+	deadLetters, err := setUpWriteCommunicator(config, writeCommunicator, journal)
 	if err != nil {
+		writeCommunicator.Close(context.Background())
 		return nil, err
 	}
-	client := http.New(*self.url, self.insecureSkipVerify)
-	writeCommunicator := NewHttpCommunicator(client)
 	storage := &Storage{
-		selfMetricsEntity:      self.selfMetricsEntity,
+		config:                 config,
+		selfMetricsEntity:      config.SelfMetricEntity,
 		memstore:               memstore,
-		dataCompacter:          NewDataCompacter(self.groupParams),
+		spillover:              spillover,
+		journal:                journal,
+		deadLetters:            deadLetters,
+		dataCompacter:          dataCompacter,
+		metadataCompacter:      metadataCompacter,
 		writeCommunicator:      writeCommunicator,
-		updateInterval:         self.updateInterval,
+		handOffQueue:           make(chan *releasedBatch, 1),
+		stopDelivery:           make(chan struct{}),
+		deliveryDone:           make(chan struct{}),
+		abandon:                make(chan struct{}),
+		updateInterval:         config.UpdateInterval,
 		selfMetricSendInterval: 15 * time.Second,
 		isUpdating:             false,
-		metricPrefix:           self.metricPrefix,
+		metricPrefix:           config.MetricPrefix,
 	}
+	storage.setListeners(config, deadLetters)
+	go storage.deliveryTask(config.UpdateInterval)
 	return storage, nil
 }
 
+// setListeners makes Storage report the commands it drops itself like its
+// write communicator does, to config.Listener and to the dead-letter handler.
+// The memstore and the spillover report their drops to config.Listener.
+func (self *Storage) setListeners(config Config, deadLetters DeadLetterSink) {
+	self.listeners.SetListener(config.Listener)
+	self.memstore.SetListener(config.Listener)
+	if self.spillover != nil {
+		self.spillover.SetListener(config.Listener)
+	}
+	if deadLetters != nil {
+		self.listeners.SetDeadLetterHandler(self.journal.filter(deadLetters))
+	} else {
+		self.listeners.SetDeadLetterHandler(self.journal.filter(config.DeadLetterHandler))
+	}
+}
+
+// setUpWriteCommunicator sets the listener and the dead-letter handler of the
+// communicator, filtered by journal. It returns the sink Storage owns: the one
+// it opened for config.DeadLetterFile, or config.DeadLetterHandler if that is a
+// DeadLetterSink.
+func setUpWriteCommunicator(config Config, writeCommunicator transport, journal journal) (DeadLetterSink, error) {
+	writeCommunicator.SetListener(config.Listener)
+	if config.DeadLetterFile == "" {
+		writeCommunicator.SetDeadLetterHandler(journal.filter(config.DeadLetterHandler))
+		sink, _ := config.DeadLetterHandler.(DeadLetterSink)
+		return sink, nil
+	}
+	if config.DeadLetterHandler != nil {
+		return nil, errors.New("DeadLetterFile and DeadLetterHandler cannot be set together")
+	}
+	deadLetters, err := OpenFileDeadLetterSink(config.DeadLetterFile)
+	if err != nil {
+		return nil, err
+	}
+	writeCommunicator.SetDeadLetterHandler(journal.filter(deadLetters))
+	return deadLetters, nil
+}
+
 func NewFactoryFromConfig(config Config) StorageFactory {
-	switch config.Url.Scheme {
-	case "udp", "tcp":
-		return NewNetworkStorageFactory(
-			config.SelfMetricEntity,
-			config.Url,
-			config.MemstoreLimit,
-			config.SenderGoroutineLimit,
-			config.UpdateInterval,
-			config.MetricPrefix,
-			config.GroupParams,
-		)
-	case "http", "https":
-		return NewHttpStorageFactory(
-			config.SelfMetricEntity,
-			config.Url,
-			config.InsecureSkipVerify,
-			config.MemstoreLimit,
-			config.UpdateInterval,
-			config.MetricPrefix,
-			config.GroupParams,
-		)
-	default:
-		return NewHttpStorageFactory(
-			config.SelfMetricEntity,
-			config.Url,
-			config.InsecureSkipVerify,
-			config.MemstoreLimit,
-			config.UpdateInterval,
-			config.MetricPrefix,
-			config.GroupParams,
-		)
+	if len(config.FailoverUrls) > 0 {
+		// Only the network communicator fails over, it sends to http urls through the command API.
+		return &NetworkStorageFactory{config: config}
+	}
+	if isNetworkUrl(config.Url) {
+		return &NetworkStorageFactory{config: config}
 	}
+	return &HttpStorageFactory{config: config}
 }
@@ -0,0 +1,404 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+// fanOutQueueSize is the number of released batches buffered for each destination.
+const fanOutQueueSize = 100
+
+type fanOutBatch struct {
+	seriesCommandsChunk []*Chunk
+	entityTagCommands   []*net.EntityTagCommand
+	propertyCommands    []*net.PropertyCommand
+	messageCommands     []*net.MessageCommand
+	delivered           func()
+}
+
+type fanOutDestination struct {
+	name         string
+	communicator transport
+	queue        chan *fanOutBatch
+	// spillover, if not nil, takes the batches of the destination while it is
+	// disconnected or its queue is full, until it has caught up again.
+	spillover *Spillover
+	done      chan struct{}
+	// dropped counts the commands discarded because the queue of the destination was full.
+	dropped UndeliveredError
+}
+
+// FanOutCommunicator replicates every batch to several destinations. Each
+// destination has its own queue and communicator, so a slow or unreachable
+// destination delays only itself. A destination with a spillover spills the
+// batches it cannot take and requeues them once it is connected again. Without
+// one, a batch that finds the queue full is dropped for that destination right
+// away. A dropped batch still counts as delivered, so the write-ahead log does
+// not keep it for the destination either.
+type FanOutCommunicator struct {
+	destinations    []*fanOutDestination
+	requeueInterval time.Duration
+
+	closed      bool
+	queueing    sync.WaitGroup
+	abort       chan struct{}
+	undelivered UndeliveredError
+
+	listenerHolder
+	mutex sync.Mutex
+}
+
+// NewFanOutCommunicator takes ownership of the communicators, names[i] is the
+// value of the "destination" self-metric tag of communicators[i]. The communicators
+// must be created by this package.
+func NewFanOutCommunicator(names []string, communicators []IWriteCommunicator) (*FanOutCommunicator, error) {
+	transports := []transport{}
+	for i, communicator := range communicators {
+		transport, ok := communicator.(transport)
+		if !ok {
+			return nil, fmt.Errorf("communicator %v is a %T, not a communicator of this package", i, communicator)
+		}
+		transports = append(transports, transport)
+	}
+	return newFanOutCommunicator(names, transports, nil, 0)
+}
+
+// newFanOutCommunicator backs communicators[i] with spillovers[i] if spillovers is
+// not nil. Spilled batches are requeued every requeueInterval.
+func newFanOutCommunicator(names []string, communicators []transport, spillovers []*Spillover, requeueInterval time.Duration) (*FanOutCommunicator, error) {
+	if len(names) != len(communicators) || len(communicators) == 0 {
+		return nil, fmt.Errorf("expected a name for each of at least one communicator, got %v names and %v communicators", len(names), len(communicators))
+	}
+	if spillovers != nil && len(spillovers) != len(communicators) {
+		return nil, fmt.Errorf("expected a spillover for each communicator, got %v spillovers and %v communicators", len(spillovers), len(communicators))
+	}
+	fc := &FanOutCommunicator{abort: make(chan struct{}), requeueInterval: requeueInterval}
+	for i := range communicators {
+		destination := &fanOutDestination{
+			name:         names[i],
+			communicator: communicators[i],
+			queue:        make(chan *fanOutBatch, fanOutQueueSize),
+			done:         make(chan struct{}),
+		}
+		if spillovers != nil {
+			destination.spillover = spillovers[i]
+		}
+		fc.destinations = append(fc.destinations, destination)
+		go fc.forward(destination)
+	}
+	return fc, nil
+}
+
+// forward queues the batches of the destination on its communicator. Spilled
+// batches are newer than the queued ones, they are requeued only while the
+// queue is empty.
+func (self *FanOutCommunicator) forward(destination *fanOutDestination) {
+	defer close(destination.done)
+	var requeue <-chan time.Time
+	if destination.spillover != nil {
+		ticker := time.NewTicker(self.requeueInterval)
+		defer ticker.Stop()
+		requeue = ticker.C
+	}
+	for {
+		select {
+		case batch, ok := <-destination.queue:
+			if !ok {
+				if destination.spillover != nil {
+					self.requeueSpilled(destination)
+				}
+				return
+			}
+			if self.isAborted() {
+				if destination.spillover == nil || !self.spill(destination, batch) {
+					self.dropCommands(&self.undelivered, errCloseDeadline, batch.seriesCommandsChunk, batch.entityTagCommands, batch.propertyCommands, batch.messageCommands)
+				}
+				continue
+			}
+			destination.communicator.queuedSendData(batch.seriesCommandsChunk, batch.entityTagCommands, batch.propertyCommands, batch.messageCommands, batch.delivered)
+		case <-requeue:
+			if len(destination.queue) == 0 {
+				self.requeueSpilled(destination)
+			}
+		}
+	}
+}
+
+func (self *FanOutCommunicator) requeueSpilled(destination *fanOutDestination) {
+	destination.spillover.requeue(func() transport { return destination.communicator }, self.isAborted, nil)
+}
+
+func (self *FanOutCommunicator) isAborted() bool {
+	select {
+	case <-self.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// spill writes the batch to the spillover of the destination, which then counts
+// as delivered for it.
+func (self *FanOutCommunicator) spill(destination *fanOutDestination, batch *fanOutBatch) bool {
+	err := destination.spillover.Spill(batch.seriesCommandsChunk, batch.entityTagCommands, batch.propertyCommands, batch.messageCommands)
+	if err != nil {
+		logger.Error("Could not spill batch of ", destination.name, ": ", err)
+		return false
+	}
+	batch.delivered()
+	return true
+}
+
+// enqueue passes the batch to the destination without waiting. It is spilled while
+// the destination is disconnected, its queue is full or earlier batches are still
+// spilled. If it can neither be queued nor spilled, it is dropped for the destination.
+func (self *FanOutCommunicator) enqueue(destination *fanOutDestination, batch *fanOutBatch) {
+	if destination.spillover != nil {
+		if (!destination.spillover.isEmpty() || !destination.communicator.IsConnected()) && self.spill(destination, batch) {
+			return
+		}
+		select {
+		case destination.queue <- batch:
+			return
+		default:
+		}
+		if self.spill(destination, batch) {
+			return
+		}
+	}
+
+	select {
+	case destination.queue <- batch:
+		return
+	default:
+	}
+	logger.Error("Queue of ", destination.name, " is full, dropping batch")
+	self.dropCommands(&destination.dropped, errQueueFull, batch.seriesCommandsChunk, batch.entityTagCommands, batch.propertyCommands, batch.messageCommands)
+	// The other destinations must not be held back, or the released data would be replayed to them.
+	batch.delivered()
+}
+
+// QueuedSendData queues a copy of the batch for every destination.
+func (self *FanOutCommunicator) QueuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand) {
+	self.queuedSendData(seriesCommandsChunk, entityTagCommands, propertyCommands, messageCommands, nil)
+}
+
+// queuedSendData calls delivered once all destinations have written the batch
+// out, spilled it or dropped it.
+func (self *FanOutCommunicator) queuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand, delivered func()) {
+	if !self.startQueueing() {
+		self.dropCommands(&self.undelivered, errCloseDeadline, seriesCommandsChunk, entityTagCommands, propertyCommands, messageCommands)
+		return
+	}
+	defer self.queueing.Done()
+	ack := newDeliveryAck(len(self.destinations), delivered)
+	for i, destination := range self.destinations {
+		// The senders consume the chunks, so every destination but the last gets its own copy.
+		chunks := seriesCommandsChunk
+		if i < len(self.destinations)-1 {
+			chunks = cloneChunks(seriesCommandsChunk)
+		}
+		batch := &fanOutBatch{
+			seriesCommandsChunk: chunks,
+			entityTagCommands:   entityTagCommands,
+			propertyCommands:    propertyCommands,
+			messageCommands:     messageCommands,
+			delivered:           ack.done,
+		}
+		self.enqueue(destination, batch)
+	}
+}
+
+func cloneChunks(chunks []*Chunk) []*Chunk {
+	clones := make([]*Chunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		clone := NewChunk()
+		clone.PushBackList(chunk.List)
+		clones = append(clones, clone)
+	}
+	return clones
+}
+
+func (self *FanOutCommunicator) startQueueing() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed {
+		return false
+	}
+	self.queueing.Add(1)
+	return true
+}
+
+func (self *FanOutCommunicator) PriorSendData(seriesCommands []*net.SeriesCommand, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand) {
+	wg := sync.WaitGroup{}
+	for _, destination := range self.destinations {
+		wg.Add(1)
+		go func(communicator transport) {
+			defer wg.Done()
+			communicator.PriorSendData(seriesCommands, entityTagCommands, propertyCommands, messageCommands)
+		}(destination.communicator)
+	}
+	wg.Wait()
+}
+
+// SendAndWait sends the batch to all destinations in parallel. The returned
+// BatchError holds the errors of every destination, each prefixed with its name.
+func (self *FanOutCommunicator) SendAndWait(ctx context.Context, batch *Batch) error {
+	errs := make([]error, len(self.destinations))
+	wg := sync.WaitGroup{}
+	for i, destination := range self.destinations {
+		wg.Add(1)
+		go func(i int, communicator transport) {
+			defer wg.Done()
+			errs[i] = communicator.SendAndWait(ctx, batch)
+		}(i, destination.communicator)
+	}
+	wg.Wait()
+
+	batchError := BatchError{}
+	for i, err := range errs {
+		if destinationError, ok := err.(BatchError); ok {
+			for _, sendError := range destinationError {
+				batchError = append(batchError, &SendError{
+					CommandType: sendError.CommandType,
+					Count:       sendError.Count,
+					StatusCode:  sendError.StatusCode,
+					Err:         fmt.Errorf("%v: %v", self.destinations[i].name, sendError.Err),
+				})
+			}
+		}
+	}
+	return batchError.errorOrNil()
+}
+
+// IsConnected reports whether at least one destination is reachable. Storage then
+// keeps handing batches over, a destination that is down is covered by its own spillover.
+func (self *FanOutCommunicator) IsConnected() bool {
+	for _, destination := range self.destinations {
+		if destination.communicator.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *FanOutCommunicator) SetListener(listener Listener) {
+	self.listenerHolder.SetListener(listener)
+	for _, destination := range self.destinations {
+		destination.communicator.SetListener(listener)
+		if destination.spillover != nil {
+			destination.spillover.SetListener(listener)
+		}
+	}
+}
+
+func (self *FanOutCommunicator) SetDeadLetterHandler(handler DeadLetterHandler) {
+	self.listenerHolder.SetDeadLetterHandler(handler)
+	for _, destination := range self.destinations {
+		destination.communicator.SetDeadLetterHandler(journal{spillover: destination.spillover}.filter(handler))
+	}
+}
+
+// Close closes all destinations in parallel. The returned *UndeliveredError sums
+// the commands that did not reach each of the destinations.
+func (self *FanOutCommunicator) Close(ctx context.Context) error {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return nil
+	}
+	self.closed = true
+	self.mutex.Unlock()
+
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(self.abort)
+		case <-stopWatching:
+		}
+	}()
+
+	self.queueing.Wait()
+	errs := make([]error, len(self.destinations))
+	wg := sync.WaitGroup{}
+	for i, destination := range self.destinations {
+		close(destination.queue)
+		wg.Add(1)
+		go func(i int, destination *fanOutDestination) {
+			defer wg.Done()
+			select {
+			case <-destination.done:
+			case <-ctx.Done():
+			}
+			errs[i] = destination.communicator.Close(ctx)
+			<-destination.done
+		}(i, destination)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if undelivered, ok := err.(*UndeliveredError); ok {
+			self.undelivered.add(undelivered)
+		}
+	}
+	return self.undelivered.errorOrNil()
+}
+
+// SelfMetricValues returns the self-metrics of every destination tagged with its name.
+func (self *FanOutCommunicator) SelfMetricValues() []*metricValue {
+	metricValues := []*metricValue{}
+	for _, destination := range self.destinations {
+		for _, metricValue := range destination.communicator.SelfMetricValues() {
+			tags := map[string]string{"destination": destination.name}
+			for name, value := range metricValue.tags {
+				tags[name] = value
+			}
+			metricValue.tags = tags
+			metricValues = append(metricValues, metricValue)
+		}
+		dropped := &destination.dropped
+		metricValues = append(metricValues,
+			&metricValue{
+				name:  "fanout.queue.size",
+				tags:  map[string]string{"destination": destination.name},
+				value: net.Int64(len(destination.queue)),
+			},
+			&metricValue{
+				name: "fanout.commands.dropped",
+				tags: map[string]string{"destination": destination.name},
+				value: net.Int64(atomic.LoadUint64(&dropped.SeriesCommands) + atomic.LoadUint64(&dropped.PropertyCommands) +
+					atomic.LoadUint64(&dropped.MessageCommands) + atomic.LoadUint64(&dropped.EntityTagCommands)),
+			},
+		)
+		if destination.spillover != nil {
+			metricValues = append(metricValues, &metricValue{
+				name:  "fanout.spillover.commands",
+				tags:  map[string]string{"destination": destination.name},
+				value: net.Int64(destination.spillover.CommandCount()),
+			})
+		}
+	}
+	return metricValues
+}
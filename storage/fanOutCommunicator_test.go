@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+func TestFanOutCommunicator(t *testing.T) {
+	primary, replica := &fakeCommunicator{connected: true}, &fakeCommunicator{}
+	communicator, err := NewFanOutCommunicator([]string{"primary", "replica"}, []IWriteCommunicator{primary, replica})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !communicator.IsConnected() {
+		t.Error("fan-out is disconnected while the primary is connected")
+	}
+
+	delivered := make(chan struct{}, 2)
+	communicator.queuedSendData(seriesCommandsToChunks(seriesCommands("entity001", 3)), nil, nil, nil, func() { delivered <- struct{}{} })
+	if err := communicator.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(delivered) != 1 {
+		t.Error("delivered was called ", len(delivered), " times")
+	}
+	for _, destination := range []*fakeCommunicator{primary, replica} {
+		if len(destination.batches) != 1 || len(destination.batches[0]) != 3 {
+			t.Error("batch was not replicated: ", destination.batches)
+		}
+	}
+}
+
+func TestFanOutCommunicatorSpillsForDisconnectedReplica(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spillover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	primarySpillover, _ := OpenSpillover(filepath.Join(dir, "primary"), 0, 0)
+	replicaSpillover, _ := OpenSpillover(filepath.Join(dir, "replica"), 0, 0)
+
+	primary, replica := &fakeCommunicator{connected: true}, &fakeCommunicator{}
+	communicator, err := newFanOutCommunicator([]string{"primary", "replica"}, []transport{primary, replica},
+		[]*Spillover{primarySpillover, replicaSpillover}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := make(chan struct{}, 3)
+	for i := 0; i < 2; i++ {
+		communicator.queuedSendData(seriesCommandsToChunks(seriesCommands("entity001", i+1)), nil, nil, nil, func() { delivered <- struct{}{} })
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatal("batch was not acknowledged while the replica is down")
+		}
+	}
+	if replicaSpillover.CommandCount() != 3 {
+		t.Fatal("batches of the replica were not spilled: ", replicaSpillover.CommandCount())
+	}
+
+	replica.Lock()
+	replica.connected = true
+	replica.Unlock()
+	// Spilled data is still pending, so the next batch is spilled behind it.
+	communicator.queuedSendData(seriesCommandsToChunks(seriesCommands("entity001", 3)), nil, nil, nil, func() { delivered <- struct{}{} })
+	deadline := time.Now().Add(time.Second)
+	for !replicaSpillover.isEmpty() {
+		if time.Now().After(deadline) {
+			t.Fatal("spilled data was not requeued to the replica: ", replicaSpillover.CommandCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := communicator.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, destination := range map[string]*fakeCommunicator{"primary": primary, "replica": replica} {
+		if len(destination.batches) != 3 {
+			t.Fatal(name, " got ", len(destination.batches), " batches")
+		}
+		for i, batch := range destination.batches {
+			if len(batch) != i+1 {
+				t.Error(name, " got batch ", i, " out of order: ", len(batch))
+			}
+		}
+	}
+}
+
+// blockingCommunicator accepts batches only once release is closed.
+type blockingCommunicator struct {
+	fakeCommunicator
+	release chan struct{}
+}
+
+func (self *blockingCommunicator) queuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, properties []*net.PropertyCommand, messages []*net.MessageCommand, delivered func()) {
+	<-self.release
+	self.fakeCommunicator.queuedSendData(seriesCommandsChunk, entityTagCommands, properties, messages, delivered)
+}
+
+func TestFanOutCommunicatorAcknowledgesDroppedBatches(t *testing.T) {
+	primary := &fakeCommunicator{connected: true}
+	replica := &blockingCommunicator{fakeCommunicator{connected: true}, make(chan struct{})}
+	communicator, err := NewFanOutCommunicator([]string{"primary", "replica"}, []IWriteCommunicator{primary, replica})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &recordingListener{}
+	communicator.SetListener(listener)
+
+	// One batch is stuck in the replica and fanOutQueueSize wait in its queue.
+	delivered := int64(0)
+	batches := fanOutQueueSize + 3
+	for i := 0; i < batches; i++ {
+		communicator.queuedSendData(seriesCommandsToChunks(seriesCommands("entity001", 1)), nil, nil, nil, func() { atomic.AddInt64(&delivered, 1) })
+	}
+	if dropped := listener.dropped("series"); dropped == 0 {
+		t.Error("no batch was dropped for the full replica queue")
+	}
+	close(replica.release)
+	if err := communicator.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&delivered) != int64(batches) {
+		t.Error("dropped batches were not acknowledged: ", atomic.LoadInt64(&delivered), " of ", batches)
+	}
+}
+
+// plainCommunicator implements only the methods of IWriteCommunicator.
+type plainCommunicator struct{}
+
+func (self plainCommunicator) QueuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, properties []*net.PropertyCommand, messages []*net.MessageCommand) {
+}
+func (self plainCommunicator) PriorSendData(seriesCommands []*net.SeriesCommand, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand) {
+}
+func (self plainCommunicator) SelfMetricValues() []*metricValue { return nil }
+
+func TestNewFanOutCommunicatorRejectsForeignCommunicators(t *testing.T) {
+	communicators := []IWriteCommunicator{&fakeCommunicator{connected: true}, plainCommunicator{}}
+	if _, err := NewFanOutCommunicator([]string{"primary", "replica"}, communicators); err == nil {
+		t.Error("expected an error for a communicator without the transport methods")
+	}
+}
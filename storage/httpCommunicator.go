@@ -16,202 +16,599 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/glog"
-
 	"github.com/axibase/atsd-api-go/http"
 	"github.com/axibase/atsd-api-go/net"
 )
 
 type HttpCommunicator struct {
-	client *http.Client
+	client *httpApiClient
+
+	seriesCommandsChunkChan chan *queuedSeriesChunk
+	propertyCommands        chan *queuedPropertyCommands
+	entityTag               chan *queuedEntityTagCommands
+	messageCommands         chan *queuedMessageCommands
+	counters                []*httpCounters
+
+	// maxBatchSize is the largest number of commands sent in one request.
+	maxBatchSize int
+
+	isConnected bool
 
-	seriesCommandsChunkChan chan *Chunk
-	propertyCommands        chan []*net.PropertyCommand
-	entityTag               chan []*net.EntityTagCommand
-	messageCommands         chan []*net.MessageCommand
-	counters                *httpCounters
+	closed      bool
+	queueing    sync.WaitGroup
+	senders     sync.WaitGroup
+	quit        chan struct{}
+	abort       chan struct{}
+	undelivered UndeliveredError
+	listenerHolder
+	mutex sync.Mutex
 }
 
 type httpCounters struct {
-	series, entityTag, prop, messages struct{ sent, dropped uint64 }
+	series, entityTag, prop, messages commandCounters
 }
 
+// commandCounters counts commands of one type. rejected commands were refused by
+// ATSD and passed to the dead-letter handler.
+type commandCounters struct {
+	sent, dropped, rejected uint64
+}
+
+// NewHttpCommunicator sends to the url of the atsd-api-go client, authenticated by
+// the user info of the url. The client itself is not used, so its TLS settings
+// are not either: create the Storage from a Config to set InsecureSkipVerify.
 func NewHttpCommunicator(client *http.Client) *HttpCommunicator {
+	config := GetDefaultConfig()
+	config.Url = client.Url()
+	// The config has no credentials or TLS files that could fail to load.
+	restClient, _ := newHttpApiClient(config, config.Url)
+	return newHttpCommunicator(restClient, 1, config.HttpMaxBatchSize)
+}
+
+// newHttpCommunicator creates a communicator with senderCount goroutines sending
+// requests of at most maxBatchSize commands. Series and messages are spread over
+// all of them, properties and entity tags are sent by the first one only, so the
+// updates of a property or an entity reach ATSD in the order they were queued.
+func newHttpCommunicator(client *httpApiClient, senderCount, maxBatchSize int) *HttpCommunicator {
+	if senderCount <= 0 {
+		senderCount = 1
+	}
+	if maxBatchSize <= 0 {
+		maxBatchSize = GetDefaultConfig().HttpMaxBatchSize
+	}
 	hc := &HttpCommunicator{
 		client:                  client,
-		seriesCommandsChunkChan: make(chan *Chunk),
-		propertyCommands:        make(chan []*net.PropertyCommand),
-		entityTag:               make(chan []*net.EntityTagCommand),
-		messageCommands:         make(chan []*net.MessageCommand),
-		counters:                &httpCounters{},
+		seriesCommandsChunkChan: make(chan *queuedSeriesChunk, seriesCommandsChunkChannelBufferSize),
+		propertyCommands:        make(chan *queuedPropertyCommands),
+		entityTag:               make(chan *queuedEntityTagCommands),
+		messageCommands:         make(chan *queuedMessageCommands),
+		counters:                make([]*httpCounters, senderCount),
+		maxBatchSize:            maxBatchSize,
+		isConnected:             true,
+		quit:                    make(chan struct{}),
+		abort:                   make(chan struct{}),
+		listenerHolder:          listenerHolder{credentials: client.credentials},
+	}
+	for i := 0; i < senderCount; i++ {
+		hc.counters[i] = &httpCounters{}
+		sender := &httpSender{hc: hc, counters: hc.counters[i], sendsMetadata: i == 0}
+		hc.senders.Add(1)
+		go sender.run()
 	}
-	go func() {
-		for {
-			expBackoff := NewExpBackoff(100*time.Millisecond, 5*time.Minute)
-			select {
-			case entityTag := <-hc.entityTag:
-				entities := entityTagCommandsToEntities(entityTag)
-				for _, entity := range entities {
-					err := hc.client.Entities.Update(entity)
-					if err != nil {
-						tryWhileNotComplete(func() error { return hc.client.Entities.Create(entity) }, "entity update", expBackoff)
-					}
-					atomic.AddUint64(&hc.counters.entityTag.sent, 1)
-				}
 
-			case propertyCommands := <-hc.propertyCommands:
-				if len(propertyCommands) > 0 {
-					properties := propertyCommandsToProperties(propertyCommands)
-					tryWhileNotComplete(func() error { return hc.client.Properties.Insert(properties) }, "properties insert", expBackoff)
-					atomic.AddUint64(&hc.counters.prop.sent, uint64(len(properties)))
-				}
-			case messageCommands := <-hc.messageCommands:
-				if len(messageCommands) > 0 {
-					messages := messageCommandsToProperties(messageCommands)
-					tryWhileNotComplete(func() error { return hc.client.Messages.Insert(messages) }, "messages insert", expBackoff)
-					atomic.AddUint64(&hc.counters.messages.sent, uint64(len(messages)))
-				}
+	return hc
+}
 
-			case seriesChunk := <-hc.seriesCommandsChunkChan:
-				series := seriesCommandsChunkToSeries(seriesChunk)
-				if len(series) > 0 {
-					tryWhileNotComplete(func() error { return hc.client.Series.Insert(series) }, "series insert", expBackoff)
-					atomic.AddUint64(&hc.counters.series.sent, uint64(len(series)))
+type httpSender struct {
+	hc       *HttpCommunicator
+	counters *httpCounters
+	// sendsMetadata is set for the sender of properties and entity tags.
+	sendsMetadata bool
+}
+
+func (self *httpSender) run() {
+	defer self.hc.senders.Done()
+	var entityTags chan *queuedEntityTagCommands
+	var properties chan *queuedPropertyCommands
+	if self.sendsMetadata {
+		entityTags, properties = self.hc.entityTag, self.hc.propertyCommands
+	}
+	for {
+		select {
+		case entityTag := <-entityTags:
+			self.sendEntityTagCommands(entityTag)
+		case propertyCommands := <-properties:
+			self.sendPropertyCommands(propertyCommands)
+		case messageCommands := <-self.hc.messageCommands:
+			self.sendMessageCommands(messageCommands)
+		case seriesChunk := <-self.hc.seriesCommandsChunkChan:
+			self.sendSeriesChunk(seriesChunk)
+		case <-self.hc.quit:
+			for {
+				select {
+				case seriesChunk := <-self.hc.seriesCommandsChunkChan:
+					self.sendSeriesChunk(seriesChunk)
+				default:
+					return
 				}
 			}
-			expBackoff.Reset()
 		}
-	}()
+	}
+}
 
-	return hc
+func (self *httpSender) sendEntityTagCommands(entityTag *queuedEntityTagCommands) {
+	hc := self.hc
+	expBackoff := NewExpBackoff(100*time.Millisecond, 5*time.Minute)
+	commands := entityTag.commands
+	for i, command := range commands {
+		if hc.client.updateEntity(context.Background(), command.Entity(), command.Tags()) == nil {
+			atomic.AddUint64(&self.counters.entityTag.sent, 1)
+			continue
+		}
+		create := func() error { return hc.client.createEntity(context.Background(), command.Entity(), command.Tags()) }
+		err := hc.tryWhileNotComplete(create, "entity update", EntityTagCommandType, 1, expBackoff)
+		switch {
+		case err == nil:
+			atomic.AddUint64(&self.counters.entityTag.sent, 1)
+		case err == errAborted:
+			atomic.AddUint64(&self.counters.entityTag.dropped, uint64(len(commands)-i))
+			hc.dropCommands(&hc.undelivered, errCloseDeadline, nil, entityTag.commands[i:], nil, nil)
+			return
+		default:
+			atomic.AddUint64(&self.counters.entityTag.rejected, 1)
+			hc.rejectCommands(EntityTagCommandType, []fmt.Stringer{entityTag.commands[i]}, err)
+		}
+	}
+	entityTag.ack.done()
+}
+func (self *httpSender) sendPropertyCommands(propertyCommands *queuedPropertyCommands) {
+	hc := self.hc
+	commands := propertyCommands.commands
+	insert := func(start, end int) error {
+		return hc.client.insertProperties(context.Background(), propertyCommandsToProperties(commands[start:end]))
+	}
+	stringers := func(start, end int) []fmt.Stringer {
+		rejected := []fmt.Stringer{}
+		for _, command := range commands[start:end] {
+			rejected = append(rejected, command)
+		}
+		return rejected
+	}
+	if sent, ok := self.sendInBatches(len(commands), "properties insert", PropertyCommandType, &self.counters.prop, insert, stringers); !ok {
+		hc.dropCommands(&hc.undelivered, errCloseDeadline, nil, nil, commands[sent:], nil)
+		return
+	}
+	propertyCommands.ack.done()
+}
+func (self *httpSender) sendMessageCommands(messageCommands *queuedMessageCommands) {
+	hc := self.hc
+	commands := messageCommands.commands
+	insert := func(start, end int) error {
+		return hc.client.insertMessages(context.Background(), messageCommandsToProperties(commands[start:end]))
+	}
+	stringers := func(start, end int) []fmt.Stringer {
+		rejected := []fmt.Stringer{}
+		for _, command := range commands[start:end] {
+			rejected = append(rejected, command)
+		}
+		return rejected
+	}
+	if sent, ok := self.sendInBatches(len(commands), "messages insert", MessageCommandType, &self.counters.messages, insert, stringers); !ok {
+		hc.dropCommands(&hc.undelivered, errCloseDeadline, nil, nil, nil, commands[sent:])
+		return
+	}
+	messageCommands.ack.done()
+}
+func (self *httpSender) sendSeriesChunk(seriesChunk *queuedSeriesChunk) {
+	hc := self.hc
+	commands := make([]*net.SeriesCommand, 0, seriesChunk.chunk.Len())
+	for el := seriesChunk.chunk.Front(); el != nil; el = el.Next() {
+		commands = append(commands, el.Value.(*net.SeriesCommand))
+	}
+	seriesChunk.chunk.Init()
+	insert := func(start, end int) error {
+		chunk := NewChunk()
+		for _, command := range commands[start:end] {
+			chunk.PushBack(command)
+		}
+		return hc.client.insertSeries(context.Background(), seriesCommandsChunkToSeries(chunk))
+	}
+	stringers := func(start, end int) []fmt.Stringer {
+		rejected := []fmt.Stringer{}
+		for _, command := range commands[start:end] {
+			rejected = append(rejected, command)
+		}
+		return rejected
+	}
+	if sent, ok := self.sendInBatches(len(commands), "series insert", SeriesCommandType, &self.counters.series, insert, stringers); !ok {
+		remaining := NewChunk()
+		for _, command := range commands[sent:] {
+			remaining.PushBack(command)
+		}
+		hc.dropCommands(&hc.undelivered, errCloseDeadline, []*Chunk{remaining}, nil, nil, nil)
+		return
+	}
+	seriesChunk.ack.done()
+}
+
+// sendInBatches sends count commands with insert(start, end) in requests of at most
+// maxBatchSize commands. A request that ATSD rejects is split in halves until the
+// invalid commands are isolated, those are passed to the dead-letter handler and
+// the rest is sent. If the communicator is aborted, it returns false and the number
+// of commands handled before that; the remaining ones are counted as dropped.
+func (self *httpSender) sendInBatches(count int, taskName, commandType string, counters *commandCounters, insert func(start, end int) error, stringers func(start, end int) []fmt.Stringer) (int, bool) {
+	hc := self.hc
+	handled := 0
+	var send func(start, end int) error
+	send = func(start, end int) error {
+		expBackoff := NewExpBackoff(100*time.Millisecond, 5*time.Minute)
+		err := hc.tryWhileNotComplete(func() error { return insert(start, end) }, taskName, commandType, end-start, expBackoff)
+		switch {
+		case err == nil:
+			atomic.AddUint64(&counters.sent, uint64(end-start))
+		case err == errAborted:
+			return err
+		case end-start == 1:
+			atomic.AddUint64(&counters.rejected, 1)
+			hc.rejectCommands(commandType, stringers(start, end), err)
+		default:
+			middle := (start + end) / 2
+			if err := send(start, middle); err != nil {
+				return err
+			}
+			if err := send(middle, end); err != nil {
+				return err
+			}
+		}
+		handled = end
+		return nil
+	}
+	for start := 0; start < count; start += hc.maxBatchSize {
+		if send(start, batchEnd(start, hc.maxBatchSize, count)) != nil {
+			atomic.AddUint64(&counters.dropped, uint64(count-handled))
+			return handled, false
+		}
+	}
+	return count, true
+}
+
+func batchEnd(start, size, length int) int {
+	if start+size < length {
+		return start + size
+	}
+	return length
 }
 
-func tryWhileNotComplete(task func() error, taskName string, expBackoff *ExpBackoff) {
-	firstTime := true
-	hasErrors := false
-	for firstTime || hasErrors {
-		firstTime = false
+var errAborted = errors.New("communicator is aborted")
+
+// tryWhileNotComplete retries task, which sends count commands of commandType, until it
+// succeeds or ATSD rejects the commands as invalid, see isPermanent. It returns nil on
+// success, the rejection error, or errAborted if the communicator is aborted before that.
+func (self *HttpCommunicator) tryWhileNotComplete(task func() error, taskName, commandType string, count int, expBackoff *ExpBackoff) error {
+	for attempt := 1; ; attempt++ {
+		if self.isAborted() {
+			return errAborted
+		}
 		err := task()
-		hasErrors = err != nil
-		if hasErrors {
-			waitDuration := expBackoff.Duration()
-			glog.Error("Could not perform ", taskName, ": ", err, "waiting for ", waitDuration)
-			time.Sleep(waitDuration)
-		} else {
+		if err == nil {
+			self.setConnected(true, nil)
 			expBackoff.Reset()
+			return nil
+		}
+		self.events().OnSendError(commandType, count, err)
+		if isPermanent(err) {
+			self.setConnected(true, nil)
+			self.log().Error("Could not perform ", taskName, ", ATSD rejected ", count, " ", commandType, " commands: ", err)
+			return err
+		}
+		self.setConnected(false, err)
+		waitDuration := expBackoff.Duration()
+		self.log().Error("Could not perform ", taskName, ": ", err, "waiting for ", waitDuration)
+		self.events().OnRetry(attempt, waitDuration, err)
+		select {
+		case <-time.After(waitDuration):
+		case <-self.abort:
+			return errAborted
 		}
 	}
 }
 
 func (self *HttpCommunicator) QueuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand) {
-	self.propertyCommands <- propertyCommands
+	self.queuedSendData(seriesCommandsChunk, entityTagCommands, propertyCommands, messageCommands, nil)
+}
 
-	self.entityTag <- entityTagCommands
+func (self *HttpCommunicator) queuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand, delivered func()) {
+	if !self.startQueueing() {
+		self.dropCommands(&self.undelivered, errCloseDeadline, seriesCommandsChunk, entityTagCommands, propertyCommands, messageCommands)
+		return
+	}
+	defer self.queueing.Done()
+	ack := newDeliveryAck(3+len(seriesCommandsChunk), delivered)
 
-	self.messageCommands <- messageCommands
+	select {
+	case self.propertyCommands <- &queuedPropertyCommands{commands: propertyCommands, ack: ack}:
+	case <-self.abort:
+		self.dropCommands(&self.undelivered, errCloseDeadline, nil, nil, propertyCommands, nil)
+	}
+
+	select {
+	case self.entityTag <- &queuedEntityTagCommands{commands: entityTagCommands, ack: ack}:
+	case <-self.abort:
+		self.dropCommands(&self.undelivered, errCloseDeadline, nil, entityTagCommands, nil, nil)
+	}
+
+	select {
+	case self.messageCommands <- &queuedMessageCommands{commands: messageCommands, ack: ack}:
+	case <-self.abort:
+		self.dropCommands(&self.undelivered, errCloseDeadline, nil, nil, nil, messageCommands)
+	}
 
 	for _, val := range seriesCommandsChunk {
-		self.seriesCommandsChunkChan <- val
+		select {
+		case self.seriesCommandsChunkChan <- &queuedSeriesChunk{chunk: val, ack: ack}:
+		case <-self.abort:
+			self.dropCommands(&self.undelivered, errCloseDeadline, []*Chunk{val}, nil, nil, nil)
+		}
 	}
 }
 
+func (self *HttpCommunicator) isAborted() bool {
+	select {
+	case <-self.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *HttpCommunicator) startQueueing() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed {
+		return false
+	}
+	self.queueing.Add(1)
+	return true
+}
+
+// Close stops accepting new data and waits until the sender goroutines have sent
+// everything already queued. Whatever is still unsent when ctx is done is dropped
+// and reported in the returned *UndeliveredError.
+func (self *HttpCommunicator) Close(ctx context.Context) error {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return nil
+	}
+	self.closed = true
+	self.mutex.Unlock()
+
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(self.abort)
+		case <-stopWatching:
+		}
+	}()
+
+	self.queueing.Wait()
+	close(self.quit)
+	self.senders.Wait()
+	return self.undelivered.errorOrNil()
+}
+
 func (self *HttpCommunicator) PriorSendData(seriesCommands []*net.SeriesCommand, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand) {
-	entities := entityTagCommandsToEntities(entityTagCommands)
-	for _, entity := range entities {
-		err := self.client.Entities.Update(entity)
+	for _, command := range entityTagCommands {
+		err := self.client.updateEntity(context.Background(), command.Entity(), command.Tags())
 		if err != nil {
-			err = self.client.Entities.Create(entity)
+			err = self.client.createEntity(context.Background(), command.Entity(), command.Tags())
 			if err != nil {
-				glog.Error("Could not prior send entity update: ", err)
+				self.log().Error("Could not prior send entity update: ", err)
+				self.events().OnSendError(EntityTagCommandType, 1, err)
 			}
 		}
 	}
 	if len(propertyCommands) > 0 {
 		properties := propertyCommandsToProperties(propertyCommands)
-		err := self.client.Properties.Insert(properties)
+		err := self.client.insertProperties(context.Background(), properties)
 		if err != nil {
-			glog.Error("Could not prior send property: ", err)
+			self.log().Error("Could not prior send property: ", err)
+			self.events().OnSendError(PropertyCommandType, len(properties), err)
 		}
 	}
 
 	if len(seriesCommands) > 0 {
 		series := seriesCommandsToSeries(seriesCommands)
-		err := self.client.Series.Insert(series)
+		err := self.client.insertSeries(context.Background(), series)
+		self.setConnected(err == nil, err)
 		if err != nil {
-			glog.Error("Could not prior send series: ", err)
+			self.log().Error("Could not prior send series: ", err)
+			self.events().OnSendError(SeriesCommandType, len(seriesCommands), err)
 		}
 	}
 
 	if len(messageCommands) > 0 {
 		messages := messageCommandsToProperties(messageCommands)
-		err := self.client.Messages.Insert(messages)
+		err := self.client.insertMessages(context.Background(), messages)
 		if err != nil {
-			glog.Error("Could not prior send message: ", err)
+			self.log().Error("Could not prior send message: ", err)
+			self.events().OnSendError(MessageCommandType, len(messages), err)
 		}
 	}
 }
+func (self *HttpCommunicator) SendAndWait(ctx context.Context, batch *Batch) error {
+	batchError := BatchError{}
+	fail := func(commandType string, count int, err error) {
+		self.events().OnSendError(commandType, count, err)
+		batchError = append(batchError, newSendError(commandType, count, err))
+	}
+	for i, command := range batch.EntityTagCommands {
+		err := self.client.updateEntity(ctx, command.Entity(), command.Tags())
+		if err != nil && ctx.Err() == nil {
+			err = self.client.createEntity(ctx, command.Entity(), command.Tags())
+		}
+		if err != nil {
+			fail(EntityTagCommandType, len(batch.EntityTagCommands)-i, err)
+			break
+		}
+	}
+	if len(batch.PropertyCommands) > 0 {
+		properties := propertyCommandsToProperties(batch.PropertyCommands)
+		if err := self.client.insertProperties(ctx, properties); err != nil {
+			fail(PropertyCommandType, len(batch.PropertyCommands), err)
+		}
+	}
+	if len(batch.SeriesCommands) > 0 {
+		series := seriesCommandsToSeries(batch.SeriesCommands)
+		if err := self.client.insertSeries(ctx, series); err != nil {
+			fail(SeriesCommandType, len(batch.SeriesCommands), err)
+		}
+	}
+	if len(batch.MessageCommands) > 0 {
+		messages := messageCommandsToProperties(batch.MessageCommands)
+		if err := self.client.insertMessages(ctx, messages); err != nil {
+			fail(MessageCommandType, len(batch.MessageCommands), err)
+		}
+	}
+	return batchError.errorOrNil()
+}
+
+func (self *HttpCommunicator) SetConnected(isConnected bool) {
+	self.setConnected(isConnected, nil)
+}
+
+// setConnected updates the connection state and tells the listener when it changes.
+func (self *HttpCommunicator) setConnected(isConnected bool, err error) {
+	self.mutex.Lock()
+	changed := self.isConnected != isConnected
+	self.isConnected = isConnected
+	self.mutex.Unlock()
+	if changed && isConnected {
+		self.events().OnConnect(self.client.Url().Host)
+	} else if changed {
+		self.events().OnDisconnect(self.client.Url().Host, err)
+	}
+}
+
+func (self *HttpCommunicator) IsConnected() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.isConnected
+}
+
 func (self *HttpCommunicator) SelfMetricValues() []*metricValue {
-	return []*metricValue{
-		{
-			name: "series-commands.sent",
-			tags: map[string]string{
-				"transport": self.client.Url().Scheme,
+	metricValues := []*metricValue{}
+	for i := range self.counters {
+		metricValues = append(metricValues,
+			&metricValue{
+				name: "series-commands.sent",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].series.sent)),
+			},
+			&metricValue{
+				name: "series-commands.dropped",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].series.dropped)),
+			},
+			&metricValue{
+				name: "series-commands.rejected",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].series.rejected)),
 			},
-			value: net.Int64(atomic.LoadUint64(&self.counters.series.sent)),
-		},
-		{
-			name: "series-commands.dropped",
-			tags: map[string]string{
-				"transport": self.client.Url().Scheme,
+			&metricValue{
+				name: "message-commands.sent",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].messages.sent)),
 			},
-			value: net.Int64(atomic.LoadUint64(&self.counters.series.dropped)),
-		},
-		{
-			name: "message-commands.sent",
-			tags: map[string]string{
-				"transport": self.client.Url().Scheme,
+			&metricValue{
+				name: "message-commands.dropped",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].messages.dropped)),
 			},
-			value: net.Int64(atomic.LoadUint64(&self.counters.messages.sent)),
-		},
-		{
-			name: "message-commands.dropped",
-			tags: map[string]string{
-				"transport": self.client.Url().Scheme,
+			&metricValue{
+				name: "message-commands.rejected",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].messages.rejected)),
 			},
-			value: net.Int64(atomic.LoadUint64(&self.counters.messages.dropped)),
-		},
-		{
-			name: "property-commands.sent",
-			tags: map[string]string{
-				"transport": self.client.Url().Scheme,
+			&metricValue{
+				name: "property-commands.sent",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].prop.sent)),
 			},
-			value: net.Int64(atomic.LoadUint64(&self.counters.prop.sent)),
-		},
-		{
-			name: "property-commands.dropped",
-			tags: map[string]string{
-				"transport": self.client.Url().Scheme,
+			&metricValue{
+				name: "property-commands.dropped",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].prop.dropped)),
 			},
-			value: net.Int64(atomic.LoadUint64(&self.counters.prop.dropped)),
-		},
-		{
-			name: "entitytag-commands.sent",
-			tags: map[string]string{
-				"transport": self.client.Url().Scheme,
+			&metricValue{
+				name: "property-commands.rejected",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].prop.rejected)),
 			},
-			value: net.Int64(atomic.LoadUint64(&self.counters.entityTag.sent)),
-		},
-		{
-			name: "entitytag-commands.dropped",
-			tags: map[string]string{
-				"transport": self.client.Url().Scheme,
+			&metricValue{
+				name: "entitytag-commands.sent",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].entityTag.sent)),
 			},
-			value: net.Int64(atomic.LoadUint64(&self.counters.entityTag.dropped)),
-		},
+			&metricValue{
+				name: "entitytag-commands.dropped",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].entityTag.dropped)),
+			},
+			&metricValue{
+				name: "entitytag-commands.rejected",
+				tags: map[string]string{
+					"thread":    strconv.FormatInt(int64(i), 10),
+					"transport": self.client.Url().Scheme,
+				},
+				value: net.Int64(atomic.LoadUint64(&self.counters[i].entityTag.rejected)),
+			},
+		)
 	}
+	return metricValues
 }
 
 func seriesCommandsToSeries(seriesCommands []*net.SeriesCommand) []*http.Series {
@@ -270,18 +667,6 @@ func seriesCommandsChunkToSeries(seriesCommandsChunk *Chunk) []*http.Series {
 	}
 	return series
 }
-func entityTagCommandsToEntities(entityTagCommands []*net.EntityTagCommand) []*http.Entity {
-	entities := []*http.Entity{}
-
-	for _, command := range entityTagCommands {
-		entity := http.NewEntity(command.Entity())
-		for key, value := range command.Tags() {
-			entity.SetTag(key, value)
-		}
-		entities = append(entities, entity)
-	}
-	return entities
-}
 func propertyCommandsToProperties(propertyCommands []*net.PropertyCommand) []*http.Property {
 	properties := []*http.Property{}
 	for _, propertyCommand := range propertyCommands {
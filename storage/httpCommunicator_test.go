@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+type recordingDeadLetters struct {
+	rejected []string
+	mutex    sync.Mutex
+}
+
+func (self *recordingDeadLetters) OnRejected(commandType string, commands []fmt.Stringer, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, command := range commands {
+		self.rejected = append(self.rejected, commandType+" "+command.String())
+	}
+}
+
+type testCommand int
+
+func (self testCommand) String() string { return fmt.Sprint(int(self)) }
+
+func TestSendInBatchesBisectsRejectedCommands(t *testing.T) {
+	hc := &HttpCommunicator{maxBatchSize: 4, isConnected: true, abort: make(chan struct{})}
+	deadLetters := &recordingDeadLetters{}
+	hc.SetDeadLetterHandler(deadLetters)
+	sender := &httpSender{hc: hc, counters: &httpCounters{}}
+
+	invalid := map[int]bool{3: true, 7: true}
+	requests := 0
+	insert := func(start, end int) error {
+		requests++
+		for i := start; i < end; i++ {
+			if invalid[i] {
+				return &StatusError{Code: 400, Status: "400 Bad Request"}
+			}
+		}
+		return nil
+	}
+	stringers := func(start, end int) []fmt.Stringer {
+		commands := []fmt.Stringer{}
+		for i := start; i < end; i++ {
+			commands = append(commands, testCommand(i))
+		}
+		return commands
+	}
+
+	handled, ok := sender.sendInBatches(10, "properties insert", PropertyCommandType, &sender.counters.prop, insert, stringers)
+	if !ok || handled != 10 {
+		t.Fatalf("expected all 10 commands to be handled, got %v, %v", handled, ok)
+	}
+	if expected := []string{"property 3", "property 7"}; !reflect.DeepEqual(deadLetters.rejected, expected) {
+		t.Errorf("expected rejected commands %v, got %v", expected, deadLetters.rejected)
+	}
+	if counters := sender.counters.prop; counters.sent != 8 || counters.rejected != 2 || counters.dropped != 0 {
+		t.Errorf("unexpected counters %+v", counters)
+	}
+	// 3 batches, each rejected one bisected into 2 halves and the rejected half into 2 commands.
+	if requests != 11 {
+		t.Errorf("expected 11 requests, got %v", requests)
+	}
+}
+
+func TestHttpCommunicatorSendAndWaitCancelsRequest(t *testing.T) {
+	canceled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server notices the client going away only once the body is read.
+		io.Copy(ioutil.Discard, r.Body)
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer server.Close()
+
+	serverUrl, _ := url.Parse(server.URL)
+	client, err := newHttpApiClient(GetDefaultConfig(), serverUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := newHttpCommunicator(client, 1, 0)
+	defer hc.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = hc.SendAndWait(ctx, &Batch{SeriesCommands: seriesCommands("entity001", 1)})
+	if sendError := err.(BatchError).Get(SeriesCommandType); sendError == nil || sendError.StatusCode != 0 {
+		t.Fatal("expected a series send error without status, got ", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("the request was left running after the deadline")
+	}
+}
+
+// invalidSeries returns series commands with distinct metrics, the one at index invalid for the entity "invalid".
+func invalidSeries(count, invalid int) []*net.SeriesCommand {
+	commands := []*net.SeriesCommand{}
+	for i := 0; i < count; i++ {
+		entity := fmt.Sprint("entity", i)
+		if i == invalid {
+			entity = "invalid"
+		}
+		commands = append(commands, net.NewSeriesCommand(entity, fmt.Sprint("metric", i), net.Int64(i)).SetTimestamp(net.Millis(i)))
+	}
+	return commands
+}
+
+func TestHttpCommunicatorRejectsBadRequest(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "invalid") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	serverUrl, _ := url.Parse(server.URL)
+	client, err := newHttpApiClient(GetDefaultConfig(), serverUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := newHttpCommunicator(client, 1, 0)
+	deadLetters := &recordingDeadLetters{}
+	hc.SetDeadLetterHandler(deadLetters)
+
+	delivered := make(chan struct{})
+	hc.queuedSendData(seriesCommandsToChunks(invalidSeries(4, 2)), nil, nil, nil, func() { close(delivered) })
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rejected request was retried")
+	}
+	hc.Close(context.Background())
+	if len(deadLetters.rejected) != 1 || !strings.Contains(deadLetters.rejected[0], "e:invalid") {
+		t.Error("unexpected rejected commands: ", deadLetters.rejected)
+	}
+	// One request for each chunk, the rejected one is not retried.
+	if count := atomic.LoadInt32(&requests); count != 4 {
+		t.Error("unexpected number of requests: ", count)
+	}
+}
@@ -0,0 +1,280 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+// Listener is notified about delivery events of a write communicator. The
+// methods are called from the sender goroutines, so they must return quickly.
+// commandType is one of SeriesCommandType, PropertyCommandType,
+// MessageCommandType or EntityTagCommandType.
+type Listener interface {
+	// OnConnect is called when ATSD becomes reachable again after OnDisconnect.
+	OnConnect(endpoint string)
+	// OnDisconnect is called when ATSD stops being reachable.
+	OnDisconnect(endpoint string, err error)
+	// OnSendError is called for every failed attempt to send count commands.
+	OnSendError(commandType string, count int, err error)
+	// OnDrop is called when count commands are given up on and will not be delivered.
+	OnDrop(commandType string, count int)
+	// OnRetry is called before waiting backoff for the attempt-th retry.
+	OnRetry(attempt int, backoff time.Duration, err error)
+}
+
+// NopListener ignores all events. Embed it to implement only some of the Listener methods.
+type NopListener struct{}
+
+func (NopListener) OnConnect(endpoint string)                             {}
+func (NopListener) OnDisconnect(endpoint string, err error)               {}
+func (NopListener) OnSendError(commandType string, count int, err error)  {}
+func (NopListener) OnDrop(commandType string, count int)                  {}
+func (NopListener) OnRetry(attempt int, backoff time.Duration, err error) {}
+
+// DeadLetterHandler receives the commands that will not be delivered, because ATSD
+// rejected them as invalid or because they were dropped. The handler is called from
+// the sender goroutines.
+type DeadLetterHandler interface {
+	// OnRejected is called with the commands of commandType, each of which formats
+	// itself as a network command, and the reason they were not delivered.
+	OnRejected(commandType string, commands []fmt.Stringer, err error)
+}
+
+// listenerHolder keeps the listener and the dead-letter handler of a communicator,
+// which may be replaced while the sender goroutines are running.
+type listenerHolder struct {
+	listener    Listener
+	deadLetters DeadLetterHandler
+	// credentials of the communicator, their secrets are redacted from what is
+	// passed to the listener, the dead-letter handler and the log.
+	credentials *credentials
+	mutex       sync.RWMutex
+}
+
+func (self *listenerHolder) SetListener(listener Listener) {
+	if listener == nil {
+		listener = NopListener{}
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.listener = listener
+}
+
+func (self *listenerHolder) SetDeadLetterHandler(handler DeadLetterHandler) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.deadLetters = handler
+}
+
+func (self *listenerHolder) events() Listener {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if self.listener == nil {
+		return NopListener{}
+	}
+	return redactingListener{self.listener, self.credentials}
+}
+
+// log returns the package logger redacting the secrets of the credentials.
+func (self *listenerHolder) log() Logger {
+	return redactingLogger{logger: logger.logger, credentials: self.credentials}
+}
+
+// dropCommands counts the commands as undelivered, passes them to the dead-letter
+// handler with the reason and reports them to the listener.
+func (self *listenerHolder) dropCommands(undelivered *UndeliveredError, reason error, seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand) {
+	dropped := &UndeliveredError{}
+	dropped.addCommands(seriesCommandsChunk, entityTagCommands, propertyCommands, messageCommands)
+	undelivered.add(dropped)
+	if deadLetters := self.deadLetterHandler(); deadLetters != nil {
+		seriesCommands := []fmt.Stringer{}
+		for _, chunk := range seriesCommandsChunk {
+			for el := chunk.Front(); el != nil; el = el.Next() {
+				seriesCommands = append(seriesCommands, el.Value.(*net.SeriesCommand))
+			}
+		}
+		entityTags := []fmt.Stringer{}
+		for _, command := range entityTagCommands {
+			entityTags = append(entityTags, command)
+		}
+		properties := []fmt.Stringer{}
+		for _, command := range propertyCommands {
+			properties = append(properties, command)
+		}
+		messages := []fmt.Stringer{}
+		for _, command := range messageCommands {
+			messages = append(messages, command)
+		}
+		for _, typeCommands := range []struct {
+			commandType string
+			commands    []fmt.Stringer
+		}{
+			{EntityTagCommandType, entityTags},
+			{PropertyCommandType, properties},
+			{SeriesCommandType, seriesCommands},
+			{MessageCommandType, messages},
+		} {
+			if len(typeCommands.commands) > 0 {
+				deadLetters.OnRejected(typeCommands.commandType, typeCommands.commands, reason)
+			}
+		}
+	}
+	self.onDrop(dropped)
+}
+
+func (self *listenerHolder) deadLetterHandler() DeadLetterHandler {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if self.deadLetters == nil {
+		return nil
+	}
+	return redactingDeadLetters{self.deadLetters, self.credentials}
+}
+
+// rejectCommands passes the commands to the dead-letter handler, or logs them if
+// there is none, and reports them to the listener as dropped.
+func (self *listenerHolder) rejectCommands(commandType string, commands []fmt.Stringer, err error) {
+	if deadLetters := self.deadLetterHandler(); deadLetters != nil {
+		deadLetters.OnRejected(commandType, commands, err)
+	} else {
+		for _, command := range commands {
+			self.log().Warning("Dropping rejected command ", command, ": ", err)
+		}
+	}
+	self.events().OnDrop(commandType, len(commands))
+}
+
+// onDrop reports every non-zero count of the undelivered commands.
+func (self *listenerHolder) onDrop(undelivered *UndeliveredError) {
+	self.forEachCount(undelivered, self.events().OnDrop)
+}
+
+func (self *listenerHolder) onSendError(pending *UndeliveredError, err error) {
+	self.forEachCount(pending, func(commandType string, count int) {
+		self.events().OnSendError(commandType, count, err)
+	})
+}
+
+func (self *listenerHolder) forEachCount(counts *UndeliveredError, report func(commandType string, count int)) {
+	for _, typeCount := range []struct {
+		commandType string
+		count       uint64
+	}{
+		{EntityTagCommandType, counts.EntityTagCommands},
+		{PropertyCommandType, counts.PropertyCommands},
+		{SeriesCommandType, counts.SeriesCommands},
+		{MessageCommandType, counts.MessageCommands},
+	} {
+		if typeCount.count > 0 {
+			report(typeCount.commandType, int(typeCount.count))
+		}
+	}
+}
+
+// Logger receives the log output of the package. The default logger writes to glog.
+// The passwords of urls, and the passwords and tokens of a communicator in its own
+// messages, are redacted before they reach the logger.
+type Logger interface {
+	Error(args ...interface{})
+	Warning(args ...interface{})
+	Info(args ...interface{})
+}
+
+// glogLogger is called through redactingLogger, hence the depth of 2.
+type glogLogger struct{}
+
+func (glogLogger) Error(args ...interface{})   { glog.ErrorDepth(2, args...) }
+func (glogLogger) Warning(args ...interface{}) { glog.WarningDepth(2, args...) }
+func (glogLogger) Info(args ...interface{})    { glog.InfoDepth(2, args...) }
+
+type redactingLogger struct {
+	logger      Logger
+	credentials *credentials
+}
+
+func (self redactingLogger) Error(args ...interface{}) {
+	self.logger.Error(self.credentials.redact(fmt.Sprint(args...)))
+}
+func (self redactingLogger) Warning(args ...interface{}) {
+	self.logger.Warning(self.credentials.redact(fmt.Sprint(args...)))
+}
+func (self redactingLogger) Info(args ...interface{}) {
+	self.logger.Info(self.credentials.redact(fmt.Sprint(args...)))
+}
+
+var logger = redactingLogger{logger: glogLogger{}}
+
+// redactedError hides the passwords and tokens in the message of err, see credentials.redact.
+type redactedError struct {
+	err         error
+	credentials *credentials
+}
+
+func redactError(err error, credentials *credentials) error {
+	if err == nil {
+		return nil
+	}
+	return redactedError{err, credentials}
+}
+func (self redactedError) Error() string { return self.credentials.redact(self.err.Error()) }
+
+// Is matches the errors err wraps without exposing err itself.
+func (self redactedError) Is(target error) bool { return errors.Is(self.err, target) }
+
+// StatusCode returns the HTTP status of the response that failed, see responseStatus.
+func (self redactedError) StatusCode() int { return responseStatus(self.err) }
+
+// redactingListener and redactingDeadLetters pass the errors on through redactedError.
+type redactingListener struct {
+	Listener
+	credentials *credentials
+}
+
+func (self redactingListener) OnDisconnect(endpoint string, err error) {
+	self.Listener.OnDisconnect(self.credentials.redact(endpoint), redactError(err, self.credentials))
+}
+func (self redactingListener) OnSendError(commandType string, count int, err error) {
+	self.Listener.OnSendError(commandType, count, redactError(err, self.credentials))
+}
+func (self redactingListener) OnRetry(attempt int, backoff time.Duration, err error) {
+	self.Listener.OnRetry(attempt, backoff, redactError(err, self.credentials))
+}
+
+type redactingDeadLetters struct {
+	DeadLetterHandler
+	credentials *credentials
+}
+
+func (self redactingDeadLetters) OnRejected(commandType string, commands []fmt.Stringer, err error) {
+	self.DeadLetterHandler.OnRejected(commandType, commands, redactError(err, self.credentials))
+}
+
+// SetLogger routes the log output of the package to l, or back to glog if l is nil.
+// It should be called before any Storage is created.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = glogLogger{}
+	}
+	logger = redactingLogger{logger: l}
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingListener struct {
+	events []string
+	sync.Mutex
+}
+
+func (self *recordingListener) record(format string, args ...interface{}) {
+	self.Lock()
+	defer self.Unlock()
+	self.events = append(self.events, fmt.Sprintf(format, args...))
+}
+func (self *recordingListener) has(event string) bool {
+	self.Lock()
+	defer self.Unlock()
+	for _, recorded := range self.events {
+		if recorded == event {
+			return true
+		}
+	}
+	return false
+}
+
+// dropped sums the counts of the drop events of commandType.
+func (self *recordingListener) dropped(commandType string) int {
+	self.Lock()
+	defer self.Unlock()
+	total := 0
+	for _, recorded := range self.events {
+		var recordedType string
+		var count int
+		if _, err := fmt.Sscanf(recorded, "drop %s %d", &recordedType, &count); err == nil && recordedType == commandType {
+			total += count
+		}
+	}
+	return total
+}
+
+func (self *recordingListener) OnConnect(endpoint string) { self.record("connect") }
+func (self *recordingListener) OnDisconnect(endpoint string, err error) {
+	self.record("disconnect")
+}
+func (self *recordingListener) OnSendError(commandType string, count int, err error) {
+	self.record("send error %v %v", commandType, count)
+}
+func (self *recordingListener) OnDrop(commandType string, count int) {
+	self.record("drop %v %v", commandType, count)
+}
+func (self *recordingListener) OnRetry(attempt int, backoff time.Duration, err error) {
+	self.record("retry %v", attempt)
+}
+
+func TestNetworkCommunicatorListener(t *testing.T) {
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := unused.Addr().String()
+	unused.Close()
+
+	communicator, err := NewNetworkCommunicator(1, &url.URL{Scheme: "tcp", Host: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &recordingListener{}
+	communicator.SetListener(listener)
+	go communicator.QueuedSendData(seriesCommandsToChunks(seriesCommands("entity001", 2)), nil, nil, nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !listener.has("retry 1") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !listener.has("disconnect") || !listener.has("retry 1") {
+		t.Fatal("connection failure was not reported: ", listener.events)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	communicator.Close(ctx)
+	if !listener.has("drop series 2") {
+		t.Error("dropped commands were not reported: ", listener.events)
+	}
+}
@@ -16,9 +16,11 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/axibase/atsd-api-go/net"
 )
@@ -27,8 +29,63 @@ const (
 	minMemoryLimit = uint(10000)
 )
 
+// OverflowPolicy decides what happens to incoming commands once the memstore is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest discards incoming commands that do not fit.
+	DropNewest OverflowPolicy = iota
+	// DropOldest makes room by discarding the oldest queued command of the same series key,
+	// or the oldest queued command of the same type for properties, messages and entity tags.
+	DropOldest
+	// Block waits up to MemStore.BlockTimeout for the memstore to be released.
+	Block
+	// Reject discards the whole incoming batch if it does not fit and returns ErrMemstoreFull.
+	Reject
+)
+
+var ErrMemstoreFull = errors.New("memstore is full")
+
+type commandKind int
+
+const (
+	seriesKind commandKind = iota
+	propertyKind
+	messageKind
+	entityTagKind
+	commandKindCount
+)
+
+var commandKindNames = [commandKindCount]string{"series-commands", "property-commands", "message-commands", "entitytag-commands"}
+
+// commandKindTypes are the command types reported to the Listener.
+var commandKindTypes = [commandKindCount]string{SeriesCommandType, PropertyCommandType, MessageCommandType, EntityTagCommandType}
+
+// MemStoreQuotas limits the number of queued commands of each type on top of
+// the shared MemStore.Limit. A zero quota means the type is only bound by the shared limit.
+type MemStoreQuotas struct {
+	SeriesCommands    uint
+	PropertyCommands  uint
+	MessageCommands   uint
+	EntityTagCommands uint
+}
+
+func (self MemStoreQuotas) quota(kind commandKind) uint {
+	switch kind {
+	case seriesKind:
+		return self.SeriesCommands
+	case propertyKind:
+		return self.PropertyCommands
+	case messageKind:
+		return self.MessageCommands
+	default:
+		return self.EntityTagCommands
+	}
+}
+
 type MemStore struct {
-	seriesCommandMap *map[string]*Chunk
+	seriesCommandMap   *map[string]*Chunk
+	seriesCommandCount uint
 
 	properties []*net.PropertyCommand
 
@@ -36,9 +93,24 @@ type MemStore struct {
 
 	entityTagCommands []*net.EntityTagCommand
 
+	wal *WriteAheadLog
+
+	bytes    [commandKindCount]uint64
+	dropped  [commandKindCount]uint64
+	released chan struct{}
+	// unreported counts the drops not yet passed to listener, which is called
+	// after the memstore is unlocked.
+	unreported [commandKindCount]int
+	listener   listenerHolder
+
 	sync.Mutex
 
 	Limit uint
+	// ByteLimit caps the estimated memory footprint of queued commands, 0 means no cap.
+	ByteLimit      uint64
+	Quotas         MemStoreQuotas
+	OverflowPolicy OverflowPolicy
+	BlockTimeout   time.Duration
 }
 
 func NewMemStore(limit uint) (*MemStore, error) {
@@ -47,51 +119,346 @@ func NewMemStore(limit uint) (*MemStore, error) {
 	}
 	ms := &MemStore{
 		seriesCommandMap: &map[string]*Chunk{},
+		released:         make(chan struct{}),
 		Limit:            limit,
 	}
 	return ms, nil
 }
-func (self *MemStore) AppendSeriesCommands(commands []*net.SeriesCommand) {
+
+// AppendSeriesCommands queues the commands and returns how many of them were accepted.
+// The error is ErrMemstoreFull if the overflow policy is Reject or Block and some commands were discarded.
+func (self *MemStore) AppendSeriesCommands(commands []*net.SeriesCommand) (int, error) {
+	defer self.reportDrops()
 	self.Lock()
 	defer self.Unlock()
-	if uint(self.unsafeSize()) < self.Limit {
-		for i := 0; i < len(commands); i++ {
+	accepted := make([]*net.SeriesCommand, 0, len(commands))
+	evictedCommands := []interface{}{}
+	err := self.unsafeAdmit(seriesKind, len(commands),
+		func(i int) uint64 {
+			return estimateSeriesCommandSize(commands[i])
+		},
+		func(i int) {
 			key := self.getKey(commands[i])
 			if _, ok := (*self.seriesCommandMap)[key]; !ok {
 				(*self.seriesCommandMap)[key] = NewChunk()
 			}
 			(*self.seriesCommandMap)[key].PushBack(commands[i])
-		}
+			self.seriesCommandCount++
+			accepted = append(accepted, commands[i])
+		},
+		func(i int) (uint64, bool) {
+			chunk, ok := (*self.seriesCommandMap)[self.getKey(commands[i])]
+			if !ok || chunk.Len() == 0 {
+				return 0, false
+			}
+			evicted := chunk.Remove(chunk.Front()).(*net.SeriesCommand)
+			evictedCommands = append(evictedCommands, evicted)
+			self.seriesCommandCount--
+			return estimateSeriesCommandSize(evicted), true
+		})
+	if self.wal != nil {
+		self.logError(self.wal.AppendSeriesCommands(accepted))
+		self.logError(self.wal.appendEvicted(evictedCommands))
+	}
+	return len(accepted), err
+}
+func (self *MemStore) AppendPropertyCommands(propertyCommands []*net.PropertyCommand) (int, error) {
+	defer self.reportDrops()
+	self.Lock()
+	defer self.Unlock()
+	accepted := make([]*net.PropertyCommand, 0, len(propertyCommands))
+	evictedCommands := []interface{}{}
+	err := self.unsafeAdmit(propertyKind, len(propertyCommands),
+		func(i int) uint64 {
+			return estimatePropertyCommandSize(propertyCommands[i])
+		},
+		func(i int) {
+			self.properties = append(self.properties, propertyCommands[i])
+			accepted = append(accepted, propertyCommands[i])
+		},
+		func(i int) (uint64, bool) {
+			if len(self.properties) == 0 {
+				return 0, false
+			}
+			evicted := self.properties[0]
+			evictedCommands = append(evictedCommands, evicted)
+			self.properties = self.properties[1:]
+			return estimatePropertyCommandSize(evicted), true
+		})
+	if self.wal != nil {
+		self.logError(self.wal.AppendPropertyCommands(accepted))
+		self.logError(self.wal.appendEvicted(evictedCommands))
 	}
+	return len(accepted), err
 }
-func (self *MemStore) AppendPropertyCommands(propertyCommands []*net.PropertyCommand) {
+func (self *MemStore) AppendEntityTagCommands(entityUpdateCommands []*net.EntityTagCommand) (int, error) {
+	defer self.reportDrops()
 	self.Lock()
 	defer self.Unlock()
-	if self.unsafeSize() < self.Limit {
-		self.properties = append(self.properties, propertyCommands...)
+	accepted := make([]*net.EntityTagCommand, 0, len(entityUpdateCommands))
+	evictedCommands := []interface{}{}
+	err := self.unsafeAdmit(entityTagKind, len(entityUpdateCommands),
+		func(i int) uint64 {
+			return estimateEntityTagCommandSize(entityUpdateCommands[i])
+		},
+		func(i int) {
+			self.entityTagCommands = append(self.entityTagCommands, entityUpdateCommands[i])
+			accepted = append(accepted, entityUpdateCommands[i])
+		},
+		func(i int) (uint64, bool) {
+			if len(self.entityTagCommands) == 0 {
+				return 0, false
+			}
+			evicted := self.entityTagCommands[0]
+			evictedCommands = append(evictedCommands, evicted)
+			self.entityTagCommands = self.entityTagCommands[1:]
+			return estimateEntityTagCommandSize(evicted), true
+		})
+	if self.wal != nil {
+		self.logError(self.wal.AppendEntityTagCommands(accepted))
+		self.logError(self.wal.appendEvicted(evictedCommands))
 	}
+	return len(accepted), err
 }
-func (self *MemStore) AppendEntityTagCommands(entityUpdateCommands []*net.EntityTagCommand) {
+func (self *MemStore) AppendMessageCommands(messageCommands []*net.MessageCommand) (int, error) {
+	defer self.reportDrops()
 	self.Lock()
 	defer self.Unlock()
-	if self.unsafeSize() < self.Limit {
-		self.entityTagCommands = append(self.entityTagCommands, entityUpdateCommands...)
+	accepted := make([]*net.MessageCommand, 0, len(messageCommands))
+	evictedCommands := []interface{}{}
+	err := self.unsafeAdmit(messageKind, len(messageCommands),
+		func(i int) uint64 {
+			return estimateMessageCommandSize(messageCommands[i])
+		},
+		func(i int) {
+			self.messages = append(self.messages, messageCommands[i])
+			accepted = append(accepted, messageCommands[i])
+		},
+		func(i int) (uint64, bool) {
+			if len(self.messages) == 0 {
+				return 0, false
+			}
+			evicted := self.messages[0]
+			evictedCommands = append(evictedCommands, evicted)
+			self.messages = self.messages[1:]
+			return estimateMessageCommandSize(evicted), true
+		})
+	if self.wal != nil {
+		self.logError(self.wal.AppendMessageCommands(accepted))
+		self.logError(self.wal.appendEvicted(evictedCommands))
+	}
+	return len(accepted), err
+}
+
+// unsafeAdmit applies the overflow policy to count incoming commands of one kind.
+// size estimates the footprint of the i-th command and store stores it; evict
+// discards the oldest queued command the i-th one may replace under DropOldest
+// and returns its size, or false if there was none.
+// It may release the lock while waiting under the Block policy.
+func (self *MemStore) unsafeAdmit(kind commandKind, count int, size func(i int) uint64, store func(i int), evict func(i int) (uint64, bool)) error {
+	if self.OverflowPolicy == Reject {
+		total := uint64(0)
+		for i := 0; i < count; i++ {
+			total += size(i)
+		}
+		if !self.unsafeFits(kind, uint(count), total) {
+			self.unsafeDrop(kind, count)
+			return ErrMemstoreFull
+		}
+	}
+	deadline := time.Now().Add(self.BlockTimeout)
+	for i := 0; i < count; i++ {
+		commandSize := size(i)
+		fits := self.unsafeFits(kind, 1, commandSize)
+		switch self.OverflowPolicy {
+		case DropOldest:
+			for !fits {
+				evictedSize, ok := evict(i)
+				if !ok {
+					break
+				}
+				self.bytes[kind] -= evictedSize
+				self.unsafeDrop(kind, 1)
+				fits = self.unsafeFits(kind, 1, commandSize)
+			}
+		case Block:
+			for !fits && self.unsafeWaitForRelease(deadline) {
+				fits = self.unsafeFits(kind, 1, commandSize)
+			}
+			if !fits {
+				self.unsafeDrop(kind, count-i)
+				return ErrMemstoreFull
+			}
+		}
+		if fits {
+			store(i)
+			self.bytes[kind] += commandSize
+		} else {
+			self.unsafeDrop(kind, 1)
+		}
+	}
+	return nil
+}
+
+func (self *MemStore) unsafeDrop(kind commandKind, count int) {
+	self.dropped[kind] += uint64(count)
+	self.unreported[kind] += count
+}
+
+// reportDrops passes the drops counted since the last call to the listener.
+func (self *MemStore) reportDrops() {
+	self.Lock()
+	unreported := self.unreported
+	self.unreported = [commandKindCount]int{}
+	self.Unlock()
+	for kind, count := range unreported {
+		if count > 0 {
+			self.listener.events().OnDrop(commandKindTypes[kind], count)
+		}
+	}
+}
+
+// SetListener sets the listener told about the commands the overflow policy discards.
+func (self *MemStore) SetListener(listener Listener) {
+	self.listener.SetListener(listener)
+}
+
+func (self *MemStore) unsafeFits(kind commandKind, count uint, size uint64) bool {
+	if quota := self.Quotas.quota(kind); quota > 0 && self.unsafeCount(kind)+count > quota {
+		return false
+	}
+	if self.ByteLimit > 0 && self.unsafeBytes()+size > self.ByteLimit {
+		return false
+	}
+	return self.unsafeSize()+count <= self.Limit
+}
+
+// unsafeWaitForRelease unlocks the memstore until it is released or deadline passes.
+func (self *MemStore) unsafeWaitForRelease(deadline time.Time) bool {
+	wait := deadline.Sub(time.Now())
+	if wait <= 0 {
+		return false
+	}
+	released := self.released
+	self.Unlock()
+	defer self.Lock()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-released:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (self *MemStore) unsafeNotifyReleased() {
+	close(self.released)
+	self.released = make(chan struct{})
+}
+
+// AttachWriteAheadLog makes the memstore write every accepted command through to wal.
+// Commands left in the log by a previous run are replayed into the memstore first.
+func (self *MemStore) AttachWriteAheadLog(wal *WriteAheadLog) {
+	self.Lock()
+	self.wal = wal
+	overflowPolicy := self.OverflowPolicy
+	// Nothing releases the memstore during replay, so it must not block.
+	if overflowPolicy == Block {
+		self.OverflowPolicy = DropNewest
+	}
+	self.Unlock()
+	defer func() {
+		self.Lock()
+		self.OverflowPolicy = overflowPolicy
+		self.Unlock()
+	}()
+
+	for _, segment := range wal.sealedSegments() {
+		replayed, dropped := 0, 0
+		err := wal.readSegment(segment, func(command interface{}) {
+			accepted := 0
+			switch command := command.(type) {
+			case *net.SeriesCommand:
+				accepted, _ = self.AppendSeriesCommands([]*net.SeriesCommand{command})
+			case *net.PropertyCommand:
+				accepted, _ = self.AppendPropertyCommands([]*net.PropertyCommand{command})
+			case *net.EntityTagCommand:
+				accepted, _ = self.AppendEntityTagCommands([]*net.EntityTagCommand{command})
+			case *net.MessageCommand:
+				accepted, _ = self.AppendMessageCommands([]*net.MessageCommand{command})
+			}
+			replayed += accepted
+			dropped += 1 - accepted
+		})
+		// The replayed commands are written through to the active segment, the old one
+		// can only go if all of its commands made it there. Otherwise it is kept for the
+		// next run, which may deliver the replayed part twice but loses nothing.
+		if err != nil {
+			logger.Error("Could not replay write-ahead log, keeping the segment: ", err)
+			continue
+		}
+		if dropped > 0 {
+			logger.Error("Memstore is full, ", dropped, " of ", replayed+dropped, " commands of write-ahead log segment ",
+				segment, " were not replayed, keeping it and the later segments for the next run")
+			return
+		}
+		self.logError(wal.Remove(segment))
 	}
 }
-func (self *MemStore) AppendMessageCommands(messageCommands []*net.MessageCommand) {
+
+func (self *MemStore) WriteAheadLog() *WriteAheadLog {
 	self.Lock()
 	defer self.Unlock()
-	if self.unsafeSize() < self.Limit {
-		self.messages = append(self.messages, messageCommands...)
+	return self.wal
+}
+
+func (self *MemStore) logError(err error) {
+	if err != nil {
+		logger.Error("Write-ahead log error: ", err)
 	}
+}
 
+// ReleaseAll empties the memstore in one step. If a write-ahead log is attached,
+// the returned delivered func removes the log segment holding the released
+// commands and must be called only after they are delivered; otherwise it is nil.
+func (self *MemStore) ReleaseAll() ([]*Chunk, []*net.EntityTagCommand, []*net.PropertyCommand, []*net.MessageCommand, func()) {
+	self.Lock()
+	defer self.Unlock()
+	seriesCommandsChunks := self.unsafeReleaseSeriesCommandChunks()
+	entityTagCommands := self.entityTagCommands
+	self.entityTagCommands = nil
+	properties := self.properties
+	self.properties = nil
+	messages := self.messages
+	self.messages = nil
+	self.bytes = [commandKindCount]uint64{}
+	self.unsafeNotifyReleased()
+
+	var delivered func()
+	if self.wal != nil {
+		segment, err := self.wal.Rotate()
+		if err != nil {
+			self.logError(err)
+		} else {
+			wal := self.wal
+			delivered = func() { self.logError(wal.Remove(segment)) }
+		}
+	}
+	return seriesCommandsChunks, entityTagCommands, properties, messages, delivered
 }
 
 func (self *MemStore) ReleaseSeriesCommandChunks() []*Chunk {
 	self.Lock()
 	defer self.Unlock()
+	defer self.unsafeNotifyReleased()
+	return self.unsafeReleaseSeriesCommandChunks()
+}
+func (self *MemStore) unsafeReleaseSeriesCommandChunks() []*Chunk {
 	smap := self.seriesCommandMap
 	self.seriesCommandMap = &map[string]*Chunk{}
+	self.seriesCommandCount = 0
+	self.bytes[seriesKind] = 0
 	seriesCommandsChunks := []*Chunk{}
 	for _, val := range *smap {
 		seriesCommandsChunks = append(seriesCommandsChunks, val)
@@ -103,6 +470,8 @@ func (self *MemStore) ReleaseProperties() []*net.PropertyCommand {
 	defer self.Unlock()
 	properties := self.properties
 	self.properties = nil
+	self.bytes[propertyKind] = 0
+	self.unsafeNotifyReleased()
 	return properties
 }
 func (self *MemStore) ReleaseEntityTagCommands() []*net.EntityTagCommand {
@@ -110,6 +479,8 @@ func (self *MemStore) ReleaseEntityTagCommands() []*net.EntityTagCommand {
 	defer self.Unlock()
 	entityTagCommands := self.entityTagCommands
 	self.entityTagCommands = nil
+	self.bytes[entityTagKind] = 0
+	self.unsafeNotifyReleased()
 	return entityTagCommands
 }
 func (self *MemStore) SeriesCommandCount() uint {
@@ -118,12 +489,7 @@ func (self *MemStore) SeriesCommandCount() uint {
 	return self.unsafeSeriesCommandCount()
 }
 func (self *MemStore) unsafeSeriesCommandCount() uint {
-	commandCount := uint(0)
-
-	for _, val := range *(self.seriesCommandMap) {
-		commandCount += uint(val.Len())
-	}
-	return commandCount
+	return self.seriesCommandCount
 }
 func (self *MemStore) PropertiesCount() uint {
 	self.Lock()
@@ -156,6 +522,33 @@ func (self *MemStore) unsafeEntitiesCount() uint {
 	return uint(len(self.entityTagCommands))
 }
 
+func (self *MemStore) unsafeCount(kind commandKind) uint {
+	switch kind {
+	case seriesKind:
+		return self.unsafeSeriesCommandCount()
+	case propertyKind:
+		return self.unsafePropertiesCount()
+	case messageKind:
+		return self.unsafeMessagesCount()
+	default:
+		return self.unsafeEntitiesCount()
+	}
+}
+
+// Bytes returns the estimated memory footprint of the queued commands.
+func (self *MemStore) Bytes() uint64 {
+	self.Lock()
+	defer self.Unlock()
+	return self.unsafeBytes()
+}
+func (self *MemStore) unsafeBytes() uint64 {
+	bytes := uint64(0)
+	for kind := commandKind(0); kind < commandKindCount; kind++ {
+		bytes += self.bytes[kind]
+	}
+	return bytes
+}
+
 func (self *MemStore) Size() uint {
 	return self.EntitiesCount() + self.PropertiesCount() + self.SeriesCommandCount() + self.MessagesCount()
 }
@@ -164,6 +557,11 @@ func (self *MemStore) unsafeSize() uint {
 }
 
 func (self *MemStore) getKey(sc *net.SeriesCommand) string {
+	return seriesCommandKey(sc)
+}
+
+// seriesCommandKey identifies the series of a command by its entity, metric names and tags.
+func seriesCommandKey(sc *net.SeriesCommand) string {
 	key := sc.Entity()
 	metrics := []string{}
 	for metricName := range sc.Metrics() {
@@ -186,10 +584,77 @@ func (self *MemStore) getKey(sc *net.SeriesCommand) string {
 	return key
 }
 
+// seriesCommandsToChunks groups the commands into one chunk per series, keeping their order.
+func seriesCommandsToChunks(seriesCommands []*net.SeriesCommand) []*Chunk {
+	chunkMap := map[string]*Chunk{}
+	chunks := []*Chunk{}
+	for _, seriesCommand := range seriesCommands {
+		key := seriesCommandKey(seriesCommand)
+		if _, ok := chunkMap[key]; !ok {
+			chunkMap[key] = NewChunk()
+			chunks = append(chunks, chunkMap[key])
+		}
+		chunkMap[key].PushBack(seriesCommand)
+	}
+	return chunks
+}
+
 func (self *MemStore) ReleaseMessageCommands() []*net.MessageCommand {
 	self.Lock()
 	defer self.Unlock()
 	messages := self.messages
 	self.messages = nil
+	self.bytes[messageKind] = 0
+	self.unsafeNotifyReleased()
 	return messages
 }
+
+// SelfMetricValues reports the commands discarded by the overflow policy.
+func (self *MemStore) SelfMetricValues() []*metricValue {
+	self.Lock()
+	defer self.Unlock()
+	metricValues := []*metricValue{}
+	for kind := commandKind(0); kind < commandKindCount; kind++ {
+		metricValues = append(metricValues, &metricValue{
+			name:  "memstore." + commandKindNames[kind] + ".dropped",
+			tags:  map[string]string{},
+			value: net.Int64(self.dropped[kind]),
+		})
+	}
+	return metricValues
+}
+
+// The estimates below approximate the heap used by a queued command: a fixed
+// overhead for the command struct and its maps plus the length of every string.
+const (
+	commandOverhead  = 64
+	mapOverhead      = 48
+	mapEntryOverhead = 40
+	numberSize       = 16
+	timestampSize    = 8
+)
+
+func estimateTagsSize(tags map[string]string) uint64 {
+	size := uint64(mapOverhead)
+	for name, value := range tags {
+		size += mapEntryOverhead + uint64(len(name)+len(value))
+	}
+	return size
+}
+func estimateSeriesCommandSize(command *net.SeriesCommand) uint64 {
+	size := uint64(commandOverhead+mapOverhead+timestampSize+len(command.Entity())) + estimateTagsSize(command.Tags())
+	for name := range command.Metrics() {
+		size += mapEntryOverhead + numberSize + uint64(len(name))
+	}
+	return size
+}
+func estimatePropertyCommandSize(command *net.PropertyCommand) uint64 {
+	return uint64(commandOverhead+timestampSize+len(command.Entity())+len(command.PropType())) +
+		estimateTagsSize(command.Key()) + estimateTagsSize(command.Tags())
+}
+func estimateEntityTagCommandSize(command *net.EntityTagCommand) uint64 {
+	return uint64(commandOverhead+len(command.Entity())) + estimateTagsSize(command.Tags())
+}
+func estimateMessageCommandSize(command *net.MessageCommand) uint64 {
+	return uint64(commandOverhead+timestampSize+len(command.Entity())+len(command.Message())) + estimateTagsSize(command.Tags())
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+func seriesCommands(entity string, count int) []*net.SeriesCommand {
+	commands := []*net.SeriesCommand{}
+	for i := 0; i < count; i++ {
+		commands = append(commands, net.NewSeriesCommand(entity, "metric001", net.Int64(i)).SetTimestamp(net.Millis(i)))
+	}
+	return commands
+}
+
+func TestMemStoreOverflowPolicy(t *testing.T) {
+	cases := []struct {
+		Name             string
+		OverflowPolicy   OverflowPolicy
+		Accepted         int
+		Err              error
+		Dropped          int64
+		SeriesCount      uint
+		FirstQueuedValue int64
+	}{
+		{Name: "drop newest", OverflowPolicy: DropNewest, Accepted: 5, Dropped: 5, SeriesCount: minMemoryLimit, FirstQueuedValue: 0},
+		{Name: "drop oldest", OverflowPolicy: DropOldest, Accepted: 10, Dropped: 5, SeriesCount: minMemoryLimit, FirstQueuedValue: 5},
+		{Name: "block", OverflowPolicy: Block, Accepted: 5, Err: ErrMemstoreFull, Dropped: 5, SeriesCount: minMemoryLimit, FirstQueuedValue: 0},
+		{Name: "reject", OverflowPolicy: Reject, Accepted: 0, Err: ErrMemstoreFull, Dropped: 10, SeriesCount: minMemoryLimit - 5, FirstQueuedValue: 0},
+	}
+
+	for _, c := range cases {
+		memstore, _ := NewMemStore(minMemoryLimit)
+		memstore.OverflowPolicy = c.OverflowPolicy
+		memstore.BlockTimeout = 10 * time.Millisecond
+		listener := &recordingListener{}
+		memstore.SetListener(listener)
+
+		memstore.AppendSeriesCommands(seriesCommands("entity001", int(minMemoryLimit)-5))
+		accepted, err := memstore.AppendSeriesCommands(seriesCommands("entity001", 10))
+		if accepted != c.Accepted || err != c.Err {
+			t.Error(c.Name, " unexpected result: ", accepted, err)
+		}
+		if memstore.SeriesCommandCount() != c.SeriesCount {
+			t.Error(c.Name, " unexpected series count: ", memstore.SeriesCommandCount())
+		}
+		if dropped := memstore.SelfMetricValues()[seriesKind].value.Int64(); dropped != c.Dropped {
+			t.Error(c.Name, " unexpected dropped count: ", dropped)
+		}
+		if dropped := listener.dropped(SeriesCommandType); int64(dropped) != c.Dropped {
+			t.Error(c.Name, " unexpected drops reported to the listener: ", dropped)
+		}
+		chunks := memstore.ReleaseSeriesCommandChunks()
+		if first := chunks[0].Front().Value.(*net.SeriesCommand).Metrics()["metric001"].Int64(); first != c.FirstQueuedValue {
+			t.Error(c.Name, " unexpected oldest command: ", first)
+		}
+	}
+}
+
+func TestMemStoreBlockUntilReleased(t *testing.T) {
+	memstore, _ := NewMemStore(minMemoryLimit)
+	memstore.OverflowPolicy = Block
+	memstore.BlockTimeout = time.Minute
+	memstore.AppendSeriesCommands(seriesCommands("entity001", int(minMemoryLimit)))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		memstore.ReleaseSeriesCommandChunks()
+	}()
+	accepted, err := memstore.AppendSeriesCommands(seriesCommands("entity002", 10))
+	if accepted != 10 || err != nil {
+		t.Error("unexpected result: ", accepted, err)
+	}
+}
+
+func TestMemStoreByteLimit(t *testing.T) {
+	memstore, _ := NewMemStore(minMemoryLimit)
+	command := net.NewMessageCommand("entity001", string(make([]byte, 4096)))
+	memstore.ByteLimit = 10 * estimateMessageCommandSize(command)
+
+	commands := []*net.MessageCommand{}
+	for i := 0; i < 15; i++ {
+		commands = append(commands, command)
+	}
+	accepted, _ := memstore.AppendMessageCommands(commands)
+	if accepted != 10 || memstore.Bytes() != memstore.ByteLimit {
+		t.Error("unexpected result: accepted = ", accepted, " bytes = ", memstore.Bytes())
+	}
+
+	memstore.ReleaseMessageCommands()
+	if memstore.Bytes() != 0 {
+		t.Error("bytes were not reset on release: ", memstore.Bytes())
+	}
+}
+
+func TestMemStoreQuotas(t *testing.T) {
+	memstore, _ := NewMemStore(minMemoryLimit)
+	memstore.Quotas.MessageCommands = 100
+
+	messages := []*net.MessageCommand{}
+	for i := 0; i < int(minMemoryLimit); i++ {
+		messages = append(messages, net.NewMessageCommand("entity001", "message001"))
+	}
+	accepted, _ := memstore.AppendMessageCommands(messages)
+	if accepted != 100 {
+		t.Error("message quota was not enforced: ", accepted)
+	}
+	accepted, _ = memstore.AppendSeriesCommands(seriesCommands("entity001", 1000))
+	if accepted != 1000 {
+		t.Error("messages starved series: ", accepted)
+	}
+	if dropped := memstore.SelfMetricValues()[messageKind].value.Int64(); dropped != int64(minMemoryLimit)-100 {
+		t.Error("unexpected dropped messages: ", dropped)
+	}
+}
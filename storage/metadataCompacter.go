@@ -0,0 +1,239 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+// MetadataCompacter drops property and entity tag commands that repeat what was
+// last delivered for the same property (entity, type and key) or entity, until the
+// refresh interval has passed since it was delivered. Commands are recorded once
+// their batch is delivered, so repeats queued before that are still sent, and the
+// ones dead-lettered in the meantime are not recorded. A zero interval disables it.
+type MetadataCompacter struct {
+	refreshInterval      time.Duration
+	properties           map[string]metadataEntry
+	entityTags           map[string]metadataEntry
+	rejected             map[string]time.Time
+	suppressedProperties uint64
+	suppressedEntityTags uint64
+	lastPruned           time.Time
+	now                  func() time.Time
+	sync.Mutex
+}
+
+type metadataEntry struct {
+	hash uint64
+	sent time.Time
+}
+
+func NewMetadataCompacter(refreshInterval time.Duration) *MetadataCompacter {
+	return &MetadataCompacter{
+		refreshInterval: refreshInterval,
+		properties:      map[string]metadataEntry{},
+		entityTags:      map[string]metadataEntry{},
+		rejected:        map[string]time.Time{},
+		now:             time.Now,
+	}
+}
+
+// SetRefreshInterval replaces the refresh interval, 0 disables deduplication and
+// forgets what was sent.
+func (self *MetadataCompacter) SetRefreshInterval(refreshInterval time.Duration) {
+	self.Lock()
+	defer self.Unlock()
+	self.refreshInterval = refreshInterval
+	if refreshInterval <= 0 {
+		self.properties = map[string]metadataEntry{}
+		self.entityTags = map[string]metadataEntry{}
+		self.rejected = map[string]time.Time{}
+	}
+}
+
+func (self *MetadataCompacter) FilterProperties(propertyCommands []*net.PropertyCommand) []*net.PropertyCommand {
+	self.Lock()
+	defer self.Unlock()
+	if self.refreshInterval <= 0 {
+		return propertyCommands
+	}
+	now := self.now()
+	self.prune(now)
+	output := []*net.PropertyCommand{}
+	for _, command := range propertyCommands {
+		if self.isUnchanged(self.properties, propertyKey(command), hashTags(command.Tags()), now) {
+			self.suppressedProperties++
+			continue
+		}
+		output = append(output, command)
+	}
+	return output
+}
+
+func (self *MetadataCompacter) FilterEntityTags(entityTagCommands []*net.EntityTagCommand) []*net.EntityTagCommand {
+	self.Lock()
+	defer self.Unlock()
+	if self.refreshInterval <= 0 {
+		return entityTagCommands
+	}
+	now := self.now()
+	self.prune(now)
+	output := []*net.EntityTagCommand{}
+	for _, command := range entityTagCommands {
+		if self.isUnchanged(self.entityTags, command.Entity(), hashTags(command.Tags()), now) {
+			self.suppressedEntityTags++
+			continue
+		}
+		output = append(output, command)
+	}
+	return output
+}
+
+// onDelivered returns the delivered callback of a batch holding the commands,
+// which records them as sent before calling delivered, if not nil. It may be
+// called on a nil MetadataCompacter and then returns delivered.
+func (self *MetadataCompacter) onDelivered(entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, delivered func()) func() {
+	if self == nil || len(entityTagCommands)+len(propertyCommands) == 0 {
+		return delivered
+	}
+	return func() {
+		self.record(entityTagCommands, propertyCommands)
+		if delivered != nil {
+			delivered()
+		}
+	}
+}
+
+func (self *MetadataCompacter) record(entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand) {
+	self.Lock()
+	defer self.Unlock()
+	if self.refreshInterval <= 0 {
+		return
+	}
+	now := self.now()
+	for _, command := range propertyCommands {
+		if !self.wasRejected(command) {
+			self.properties[propertyKey(command)] = metadataEntry{hash: hashTags(command.Tags()), sent: now}
+		}
+	}
+	for _, command := range entityTagCommands {
+		if !self.wasRejected(command) {
+			self.entityTags[command.Entity()] = metadataEntry{hash: hashTags(command.Tags()), sent: now}
+		}
+	}
+}
+
+// onRejected remembers the dead-lettered property and entity tag commands, so
+// that record skips them once the rest of their batch is delivered.
+func (self *MetadataCompacter) onRejected(commandType string, commands []fmt.Stringer) {
+	if commandType != PropertyCommandType && commandType != EntityTagCommandType {
+		return
+	}
+	self.Lock()
+	defer self.Unlock()
+	if self.refreshInterval <= 0 {
+		return
+	}
+	now := self.now()
+	for _, command := range commands {
+		self.rejected[command.String()] = now
+	}
+}
+
+// wasRejected reports whether the command was dead-lettered and forgets it.
+// The network communicators pass the command lines, so commands are compared as lines.
+func (self *MetadataCompacter) wasRejected(command fmt.Stringer) bool {
+	line := command.String()
+	if _, ok := self.rejected[line]; !ok {
+		return false
+	}
+	delete(self.rejected, line)
+	return true
+}
+
+// isUnchanged reports whether the content was delivered for the key within the refresh interval.
+func (self *MetadataCompacter) isUnchanged(entries map[string]metadataEntry, key string, hash uint64, now time.Time) bool {
+	entry, ok := entries[key]
+	return ok && entry.hash == hash && now.Sub(entry.sent) < self.refreshInterval
+}
+
+// prune removes the entries older than the refresh interval, at most once per interval.
+func (self *MetadataCompacter) prune(now time.Time) {
+	if now.Sub(self.lastPruned) < self.refreshInterval {
+		return
+	}
+	for _, entries := range []map[string]metadataEntry{self.properties, self.entityTags} {
+		for key, entry := range entries {
+			if now.Sub(entry.sent) >= self.refreshInterval {
+				delete(entries, key)
+			}
+		}
+	}
+	for line, rejected := range self.rejected {
+		if now.Sub(rejected) >= self.refreshInterval {
+			delete(self.rejected, line)
+		}
+	}
+	self.lastPruned = now
+}
+
+// SelfMetricValues reports the number of suppressed property and entity tag commands.
+func (self *MetadataCompacter) SelfMetricValues() []*metricValue {
+	self.Lock()
+	defer self.Unlock()
+	return []*metricValue{
+		{
+			name:  "compacter.properties.suppressed",
+			tags:  map[string]string{},
+			value: net.Int64(self.suppressedProperties),
+		},
+		{
+			name:  "compacter.entity_tags.suppressed",
+			tags:  map[string]string{},
+			value: net.Int64(self.suppressedEntityTags),
+		},
+	}
+}
+
+func propertyKey(command *net.PropertyCommand) string {
+	return command.Entity() + "\x00" + command.PropType() + "\x00" + joinTags(command.Key())
+}
+
+func hashTags(tags map[string]string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(joinTags(tags)))
+	return hash.Sum64()
+}
+
+// joinTags writes the names and values of the tags in name order, each followed by a zero byte.
+func joinTags(tags map[string]string) string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	joined := ""
+	for _, name := range names {
+		joined += name + "\x00" + tags[name] + "\x00"
+	}
+	return joined
+}
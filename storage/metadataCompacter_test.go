@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+func TestMetadataCompacter(t *testing.T) {
+	now := time.Unix(0, 0)
+	mc := NewMetadataCompacter(time.Hour)
+	mc.now = func() time.Time { return now }
+	property := func(disk, size string) *net.PropertyCommand {
+		return net.NewPropertyCommand("disk", "nurswgvml007", "size", size).SetKey("id", disk)
+	}
+	entityTags := func(location string) *net.EntityTagCommand {
+		return net.NewEntityTagCommand("nurswgvml007", "location", location)
+	}
+
+	sent := mc.FilterProperties([]*net.PropertyCommand{property("sda", "100"), property("sdb", "100")})
+	if len(sent) != 2 {
+		t.Fatal("new properties were suppressed: ", sent)
+	}
+	if again := mc.FilterProperties(sent); len(again) != 2 {
+		t.Error("properties that were not delivered yet were suppressed: ", again)
+	}
+	mc.onDelivered(nil, sent, nil)()
+	if sent := mc.FilterProperties([]*net.PropertyCommand{property("sda", "100"), property("sdb", "200")}); len(sent) != 1 || sent[0].Tags()["size"] != "200" {
+		t.Error("expected only the changed property to be sent, got ", sent)
+	}
+	delivered := false
+	mc.onDelivered(mc.FilterEntityTags([]*net.EntityTagCommand{entityTags("NUR")}), nil, func() { delivered = true })()
+	if !delivered {
+		t.Error("the delivered callback was not called")
+	}
+	if sent := mc.FilterEntityTags([]*net.EntityTagCommand{entityTags("NUR")}); len(sent) != 0 {
+		t.Error("unchanged entity tags were sent: ", sent)
+	}
+
+	now = now.Add(time.Hour)
+	if sent := mc.FilterProperties([]*net.PropertyCommand{property("sda", "100")}); len(sent) != 1 {
+		t.Error("the property was not sent again after the refresh interval")
+	}
+	if sent := mc.FilterEntityTags([]*net.EntityTagCommand{entityTags("NUR")}); len(sent) != 1 {
+		t.Error("the entity tags were not sent again after the refresh interval")
+	}
+
+	metrics := mc.SelfMetricValues()
+	if metrics[0].value.Int64() != 1 || metrics[1].value.Int64() != 1 {
+		t.Errorf("expected 1 suppressed property and 1 entity tag command, got %v and %v", metrics[0].value, metrics[1].value)
+	}
+
+	mc.SetRefreshInterval(0)
+	if sent := mc.FilterProperties([]*net.PropertyCommand{property("sda", "100")}); len(sent) != 1 {
+		t.Error("the property was suppressed with deduplication disabled")
+	}
+}
+
+func TestStorageRecordsDeliveredMetadata(t *testing.T) {
+	config := GetDefaultConfig()
+	config.MetadataRefreshInterval = time.Hour
+	memstore, _ := NewMemStore(minMemoryLimit)
+	storage, err := newStorage(config, memstore, &fakeCommunicator{connected: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close(context.Background())
+	properties := []*net.PropertyCommand{net.NewPropertyCommand("disk", "nurswgvml007", "size", "100")}
+
+	storage.QueuedSendPropertyCommands(properties)
+	if accepted, _ := storage.QueuedSendPropertyCommands(properties); accepted != 1 {
+		t.Error("a property that was not delivered yet was suppressed")
+	}
+	storage.ForceSend()
+	if accepted, _ := storage.QueuedSendPropertyCommands(properties); accepted != 0 {
+		t.Error("a delivered property was sent again")
+	}
+}
+
+// rejectingCommunicator dead-letters every property command and delivers the rest.
+type rejectingCommunicator struct {
+	fakeCommunicator
+	handler DeadLetterHandler
+}
+
+func (self *rejectingCommunicator) SetDeadLetterHandler(handler DeadLetterHandler) {
+	self.handler = handler
+}
+
+func (self *rejectingCommunicator) queuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, properties []*net.PropertyCommand, messages []*net.MessageCommand, delivered func()) {
+	rejected := []fmt.Stringer{}
+	for _, command := range properties {
+		rejected = append(rejected, rawCommand(command.String()))
+	}
+	if len(rejected) > 0 && self.handler != nil {
+		self.handler.OnRejected(PropertyCommandType, rejected, errors.New("400 Bad Request"))
+	}
+	self.fakeCommunicator.queuedSendData(seriesCommandsChunk, entityTagCommands, nil, messages, delivered)
+}
+
+func TestStorageDoesNotRecordRejectedMetadata(t *testing.T) {
+	config := GetDefaultConfig()
+	config.MetadataRefreshInterval = time.Hour
+	memstore, _ := NewMemStore(minMemoryLimit)
+	storage, err := newStorage(config, memstore, &rejectingCommunicator{fakeCommunicator: fakeCommunicator{connected: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close(context.Background())
+	properties := []*net.PropertyCommand{net.NewPropertyCommand("disk", "nurswgvml007", "size", "100")}
+	entityTags := []*net.EntityTagCommand{net.NewEntityTagCommand("nurswgvml007", "location", "NUR")}
+
+	storage.QueuedSendPropertyCommands(properties)
+	storage.QueuedSendEntityTagCommands(entityTags)
+	storage.ForceSend()
+	if accepted, _ := storage.QueuedSendPropertyCommands(properties); accepted != 1 {
+		t.Error("a rejected property was suppressed as unchanged")
+	}
+	if accepted, _ := storage.QueuedSendEntityTagCommands(entityTags); accepted != 0 {
+		t.Error("delivered entity tags were sent again")
+	}
+}
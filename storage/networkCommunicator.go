@@ -17,9 +17,10 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"net"
+	"io"
 	"net/url"
 	"strconv"
 	"strings"
@@ -27,8 +28,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/glog"
-
 	atsdNet "github.com/axibase/atsd-api-go/net"
 )
 
@@ -38,17 +37,28 @@ const (
 )
 
 type counters struct {
-	series, entityTag, prop, messages struct{ sent, dropped uint64 }
+	series, entityTag, prop, messages commandCounts
+}
+
+type commandCounts struct {
+	sent, dropped uint64
 }
 
 type NetworkCommunicator struct {
-	seriesCommandsChunkChan chan *Chunk
-	properties              chan []*atsdNet.PropertyCommand
-	messageCommands         chan []*atsdNet.MessageCommand
-	entityTag               chan []*atsdNet.EntityTagCommand
+	seriesCommandsChunkChan chan *queuedSeriesChunk
+	properties              chan *queuedPropertyCommands
+	messageCommands         chan *queuedMessageCommands
+	entityTag               chan *queuedEntityTagCommands
 
-	protocol string
-	hostport string
+	// endpoints are tried in order, the first one is the primary.
+	endpoints         []*endpoint
+	active            int
+	failures          int
+	failoverThreshold int
+	probeInterval     time.Duration
+
+	// udpPayloadSize is the largest datagram written to udp and unixgram endpoints.
+	udpPayloadSize int
 
 	counters []*counters
 
@@ -56,33 +66,75 @@ type NetworkCommunicator struct {
 
 	isConnected bool
 
+	closed      bool
+	queueing    sync.WaitGroup
+	senders     sync.WaitGroup
+	quit        chan struct{}
+	abort       chan struct{}
+	undelivered UndeliveredError
+
+	// ctx bounds the dials and the command API posts, Close cancels it once its ctx is done.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	listenerHolder
 	mutex *sync.Mutex
 }
 
 func NewNetworkCommunicator(goroutineCount int, url *url.URL) (*NetworkCommunicator, error) {
+	config := GetDefaultConfig()
+	config.SenderGoroutineLimit = goroutineCount
+	config.Url = url
+	return newNetworkCommunicator(config)
+}
+
+// newNetworkCommunicator creates a communicator sending to config.Url, failing over
+// to config.FailoverUrls in order.
+func newNetworkCommunicator(config Config) (*NetworkCommunicator, error) {
+	goroutineCount := config.SenderGoroutineLimit
 	if goroutineCount <= 0 {
 		return nil, errors.New(fmt.Sprintf("goroutines_count should be > 0, provided value = %v", goroutineCount))
 	}
-	if url.Scheme != "tcp" && url.Scheme != "udp" {
-		return nil, errors.New(fmt.Sprintf("unsupported protocol: %v", url.Scheme))
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := newCredentials(config)
+	if err != nil {
+		return nil, err
 	}
-	if !strings.Contains(url.Host, ":") {
-		if url.Scheme == "tcp" {
-			url.Host += ":8081"
-		} else if url.Scheme == "udp" {
-			url.Host += ":8082"
+	endpoints := []*endpoint{}
+	for _, url := range append([]*url.URL{config.Url}, config.FailoverUrls...) {
+		endpoint, err := newEndpoint(url, tlsConfig, credentials)
+		if err != nil {
+			return nil, err
 		}
+		endpoints = append(endpoints, endpoint)
 	}
+	if config.FailbackProbeInterval <= 0 {
+		config.FailbackProbeInterval = GetDefaultConfig().FailbackProbeInterval
+	}
+	if config.UdpPayloadSize == 0 {
+		config.UdpPayloadSize = GetDefaultConfig().UdpPayloadSize
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	nc := &NetworkCommunicator{
-		protocol:                url.Scheme,
-		hostport:                url.Host,
+		endpoints:               endpoints,
+		failoverThreshold:       config.FailoverThreshold,
+		probeInterval:           config.FailbackProbeInterval,
+		udpPayloadSize:          int(config.UdpPayloadSize),
 		goroutinesCount:         goroutineCount,
-		seriesCommandsChunkChan: make(chan *Chunk, seriesCommandsChunkChannelBufferSize),
-		properties:              make(chan []*atsdNet.PropertyCommand),
-		messageCommands:         make(chan []*atsdNet.MessageCommand),
-		entityTag:               make(chan []*atsdNet.EntityTagCommand),
+		seriesCommandsChunkChan: make(chan *queuedSeriesChunk, seriesCommandsChunkChannelBufferSize),
+		properties:              make(chan *queuedPropertyCommands),
+		messageCommands:         make(chan *queuedMessageCommands),
+		entityTag:               make(chan *queuedEntityTagCommands),
 		counters:                make([]*counters, goroutineCount, goroutineCount),
-		isConnected:             false,
+		isConnected:             true,
+		quit:                    make(chan struct{}),
+		abort:                   make(chan struct{}),
+		ctx:                     ctx,
+		cancel:                  cancel,
+		listenerHolder:          listenerHolder{credentials: credentials},
 		mutex:                   &sync.Mutex{},
 	}
 
@@ -91,37 +143,17 @@ func NewNetworkCommunicator(goroutineCount int, url *url.URL) (*NetworkCommunica
 	}
 
 	for i := 0; i < goroutineCount; i++ {
-		go func(threadNum int, counters *counters) {
-			expBackoff := NewExpBackoff(100*time.Millisecond, 5*time.Minute)
-			senderThread := senderThread{nc: nc, expBackoff: expBackoff, threadNum: threadNum, limit: bufferSize, buffer: bytes.NewBuffer(make([]byte, 0, bufferSize))}
-			for {
-				select {
-				case entityTag := <-nc.entityTag:
-					for i := range entityTag {
-						senderThread.sendCommand(entityTag[i], "entity update")
-						atomic.AddUint64(&counters.entityTag.sent, 1)
-					}
-				case properties := <-nc.properties:
-					for i := range properties {
-						senderThread.sendCommand(properties[i], "property")
-						atomic.AddUint64(&counters.prop.sent, 1)
-					}
-				case messageCommands := <-nc.messageCommands:
-					for i := range messageCommands {
-						senderThread.sendCommand(messageCommands[i], "message")
-						atomic.AddUint64(&counters.messages.sent, 1)
-					}
-				case seriesChunk := <-nc.seriesCommandsChunkChan:
-					for el := seriesChunk.Front(); el != nil; el = seriesChunk.Front() {
-						senderThread.sendCommand(el.Value.(*atsdNet.SeriesCommand), "series")
-						seriesChunk.Remove(el)
-						atomic.AddUint64(&counters.series.sent, 1)
-					}
-				}
-				senderThread.flush()
-
-			}
-		}(i, nc.counters[i])
+		expBackoff := NewExpBackoff(100*time.Millisecond, 5*time.Minute)
+		senderThread := &senderThread{nc: nc, expBackoff: expBackoff, threadNum: i, counters: nc.counters[i], buffer: bytes.NewBuffer(make([]byte, 0, bufferSize))}
+		nc.senders.Add(1)
+		go senderThread.run()
+	}
+	if len(endpoints) > 1 {
+		if endpoints[0].isConnectionless() {
+			nc.log().Warning("Not probing ", endpoints[0], " for fail-back, ", endpoints[0].network, " sockets cannot tell whether it is up")
+		} else {
+			go nc.probePrimary()
+		}
 	}
 
 	return nc, nil
@@ -130,116 +162,676 @@ func NewNetworkCommunicator(goroutineCount int, url *url.URL) (*NetworkCommunica
 type senderThread struct {
 	nc         *NetworkCommunicator
 	expBackoff *ExpBackoff
-	conn       net.Conn
-	threadNum  int
-	buffer     *bytes.Buffer
-	limit      int
+	conn       io.WriteCloser
+	// connEndpoint is the index of the endpoint conn is connected to.
+	connEndpoint int
+	threadNum    int
+	counters     *counters
+	buffer       *bytes.Buffer
+
+	// pending counts the commands written to buffer since the last successful flush.
+	pending UndeliveredError
+	// written holds the acks of the parts that are completely in buffer.
+	written []*deliveryAck
 }
 
-func (self *senderThread) sendCommand(command fmt.Stringer, commandName string) {
-	_, err := fmt.Fprint(self.buffer, command)
-	if err != nil {
-		glog.Error("Thread ", self.threadNum, " could not send", commandName, " command: ", err)
-		return
+func (self *senderThread) run() {
+	defer self.nc.senders.Done()
+	defer self.closeConnection()
+	for {
+		if !self.receive() {
+			// Nothing else is queued, write out what has been collected so far.
+			self.flush()
+			if !self.waitAndReceive() {
+				break
+			}
+		}
+	}
+	for self.receive() {
+	}
+	self.flush()
+}
+
+// receive writes the next queued part to the buffer, or returns false if nothing is queued.
+func (self *senderThread) receive() bool {
+	select {
+	case entityTag := <-self.nc.entityTag:
+		self.sendEntityTagCommands(entityTag)
+	case properties := <-self.nc.properties:
+		self.sendPropertyCommands(properties)
+	case messageCommands := <-self.nc.messageCommands:
+		self.sendMessageCommands(messageCommands)
+	case seriesChunk := <-self.nc.seriesCommandsChunkChan:
+		self.sendSeriesChunk(seriesChunk)
+	default:
+		return false
+	}
+	return true
+}
+
+// waitAndReceive waits for the next queued part, it returns false once the communicator quits.
+func (self *senderThread) waitAndReceive() bool {
+	select {
+	case entityTag := <-self.nc.entityTag:
+		self.sendEntityTagCommands(entityTag)
+	case properties := <-self.nc.properties:
+		self.sendPropertyCommands(properties)
+	case messageCommands := <-self.nc.messageCommands:
+		self.sendMessageCommands(messageCommands)
+	case seriesChunk := <-self.nc.seriesCommandsChunkChan:
+		self.sendSeriesChunk(seriesChunk)
+	case <-self.nc.quit:
+		return false
+	}
+	return true
+}
+
+func (self *senderThread) sendEntityTagCommands(entityTag *queuedEntityTagCommands) {
+	for i := range entityTag.commands {
+		self.sendCommand(entityTag.commands[i], &self.pending.EntityTagCommands)
+	}
+	self.written = append(self.written, entityTag.ack)
+}
+func (self *senderThread) sendPropertyCommands(properties *queuedPropertyCommands) {
+	for i := range properties.commands {
+		self.sendCommand(properties.commands[i], &self.pending.PropertyCommands)
+	}
+	self.written = append(self.written, properties.ack)
+}
+func (self *senderThread) sendMessageCommands(messageCommands *queuedMessageCommands) {
+	for i := range messageCommands.commands {
+		self.sendCommand(messageCommands.commands[i], &self.pending.MessageCommands)
 	}
-	if self.buffer.Len() > self.limit {
+	self.written = append(self.written, messageCommands.ack)
+}
+func (self *senderThread) sendSeriesChunk(seriesChunk *queuedSeriesChunk) {
+	for el := seriesChunk.chunk.Front(); el != nil; el = seriesChunk.chunk.Front() {
+		self.sendCommand(el.Value.(*atsdNet.SeriesCommand), &self.pending.SeriesCommands)
+		seriesChunk.chunk.Remove(el)
+	}
+	self.written = append(self.written, seriesChunk.ack)
+}
+
+// sendCommand appends the command to the buffer and flushes it once it is full.
+func (self *senderThread) sendCommand(command fmt.Stringer, pending *uint64) {
+	self.buffer.WriteString(command.String())
+	*pending++
+	if _, endpoint := self.nc.activeEndpoint(); self.buffer.Len() > endpoint.bufferLimit() {
 		self.flush()
 	}
 }
 
-func (self *senderThread) initConnection() {
-	for self.conn == nil {
-		conn, err := net.DialTimeout(self.nc.protocol, self.nc.hostport, 5*time.Second)
+func (self *senderThread) initConnection() bool {
+	for attempt := 1; self.conn == nil; attempt++ {
+		index, endpoint := self.nc.activeEndpoint()
+		conn, err := endpoint.dial(self.nc.ctx, 5*time.Second)
 		if err != nil {
+			if self.nc.reportFailure(index, err) {
+				self.expBackoff.Reset()
+				continue
+			}
 			waitDuration := self.expBackoff.Duration()
-			glog.Error("Thread ", self.threadNum, " could not init connection, waiting for ", waitDuration, " err: ", err)
-			time.Sleep(waitDuration)
+			self.nc.log().Error("Thread ", self.threadNum, " could not init connection, waiting for ", waitDuration, " err: ", err)
+			self.nc.setConnected(false, err)
+			self.nc.events().OnRetry(attempt, waitDuration, err)
+			if !self.nc.sleep(waitDuration) {
+				return false
+			}
 		} else {
 			self.conn = conn
+			self.connEndpoint = index
 			self.expBackoff.Reset()
-			self.nc.SetConnected(true)
+			self.nc.setConnected(true, nil)
 		}
 	}
+	return true
+}
+
+func (self *senderThread) closeConnection() {
+	if self.conn != nil {
+		self.conn.Close()
+		self.conn = nil
+	}
 }
 
-func (self *senderThread) flush() {
-	firstTime := true
-	hasErrors := false
-	for firstTime || hasErrors {
-		firstTime = false
-		if !self.nc.IsConnected() {
-			self.conn = nil
+// flush writes the buffer out, retrying until it succeeds or the communicator is aborted,
+// and acknowledges the parts written to the buffer so far. Lines that ATSD rejects as
+// invalid are passed to the dead-letter handler, see rejectInvalid.
+// On abort the buffered commands are dropped and reported as undelivered.
+func (self *senderThread) flush() bool {
+	expBackoff := NewExpBackoff(100*time.Millisecond, 5*time.Minute)
+	for attempt := 1; self.buffer.Len() > 0; attempt++ {
+		if active, _ := self.nc.activeEndpoint(); !self.nc.IsConnected() || active != self.connEndpoint {
+			self.closeConnection()
 		}
-		if self.conn == nil {
-			self.initConnection()
+		if self.conn == nil && !self.initConnection() {
+			self.drop()
+			return false
 		}
-		_, err := fmt.Fprint(self.conn, self.buffer)
-		hasErrors = err != nil
-		if hasErrors {
-			glog.Error("Thread ", self.threadNum, " could not send buffer, size = ", self.buffer.Len(), " error: ", err)
-			self.conn.Close()
-			self.conn = nil
+		err := self.writeBuffer()
+		if err != nil && isPermanent(err) {
+			self.nc.reportSuccess(self.connEndpoint)
+			err = self.rejectInvalid(err)
+		}
+		if err != nil {
+			self.nc.log().Error("Thread ", self.threadNum, " could not send buffer, size = ", self.buffer.Len(), " error: ", err)
+			self.nc.onSendError(&self.pending, err)
+			failedOver := self.nc.reportFailure(self.connEndpoint, err)
+			self.closeConnection()
+			if !failedOver {
+				waitDuration := expBackoff.Duration()
+				self.nc.events().OnRetry(attempt, waitDuration, err)
+				if !self.nc.sleep(waitDuration) {
+					self.drop()
+					return false
+				}
+			}
 		} else {
+			self.nc.reportSuccess(self.connEndpoint)
 			self.buffer.Reset()
+			atomic.AddUint64(&self.counters.series.sent, self.pending.SeriesCommands)
+			atomic.AddUint64(&self.counters.prop.sent, self.pending.PropertyCommands)
+			atomic.AddUint64(&self.counters.messages.sent, self.pending.MessageCommands)
+			atomic.AddUint64(&self.counters.entityTag.sent, self.pending.EntityTagCommands)
+			self.pending = UndeliveredError{}
+		}
+	}
+	for _, ack := range self.written {
+		ack.done()
+	}
+	self.written = nil
+	return true
+}
+
+// rejectInvalid posts the buffered lines in halves until the lines ATSD rejects
+// with rejection are isolated, and passes those to the dead-letter handler. If a
+// post fails for another reason, the lines not handled yet are kept in the buffer
+// and that error is returned. Otherwise the buffer is left with no pending commands.
+func (self *senderThread) rejectInvalid(rejection error) error {
+	lines := splitLines(self.buffer.String())
+	handled := 0
+	var post func(start, end int) error
+	post = func(start, end int) error {
+		err := rejection
+		if start > 0 || end < len(lines) {
+			_, err = io.WriteString(self.conn, strings.Join(lines[start:end], ""))
+		}
+		switch {
+		case err == nil:
+			self.countLines(lines[start:end], func(counters *commandCounts) *uint64 { return &counters.sent })
+		case !isPermanent(err):
+			return err
+		case end-start == 1:
+			self.countLines(lines[start:end], func(counters *commandCounts) *uint64 { return &counters.dropped })
+			self.nc.rejectCommands(lineCommandType(lines[start]), []fmt.Stringer{rawCommand(lines[start])}, err)
+		default:
+			middle := (start + end) / 2
+			if err := post(start, middle); err != nil {
+				return err
+			}
+			if err := post(middle, end); err != nil {
+				return err
+			}
+		}
+		handled = end
+		return nil
+	}
+	err := post(0, len(lines))
+	self.keepLines(lines[handled:])
+	return err
+}
+
+// writeBuffer writes the buffer to conn. For udp and unixgram endpoints the commands
+// are packed into datagrams, and the commands that do not fit into a datagram on
+// their own are dropped. If a datagram cannot be written, the ones written before
+// it are removed from the buffer so that they are not sent twice.
+func (self *senderThread) writeBuffer() error {
+	if !self.nc.endpoints[self.connEndpoint].isConnectionless() {
+		_, err := self.conn.Write(self.buffer.Bytes())
+		return err
+	}
+	datagrams, oversized := packDatagrams(self.buffer.Bytes(), self.nc.udpPayloadSize)
+	for _, command := range oversized {
+		line := string(command)
+		self.countLines([]string{line}, func(counters *commandCounts) *uint64 { return &counters.dropped })
+		*self.pendingCount(lineCommandType(line))--
+		self.nc.rejectCommands(lineCommandType(line), []fmt.Stringer{rawCommand(line)}, fmt.Errorf("command of %v bytes is larger than the datagram payload size %v", len(line), self.nc.udpPayloadSize))
+	}
+	for i, datagram := range datagrams {
+		if _, err := self.conn.Write(datagram); err != nil {
+			for _, written := range datagrams[:i] {
+				self.countLines(splitLines(string(written)), func(counters *commandCounts) *uint64 { return &counters.sent })
+			}
+			self.keepLines(splitLines(string(bytes.Join(datagrams[i:], nil))))
+			return err
+		}
+	}
+	return nil
+}
+
+// keepLines replaces the buffer with the lines and counts them as pending.
+func (self *senderThread) keepLines(lines []string) {
+	self.buffer.Reset()
+	self.pending = UndeliveredError{}
+	for _, line := range lines {
+		self.buffer.WriteString(line)
+		*self.pendingCount(lineCommandType(line))++
+	}
+}
+
+// splitLines splits newline-terminated commands into lines, keeping the newlines.
+func splitLines(commands string) []string {
+	lines := strings.SplitAfter(commands, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// countLines adds the lines to the counter picked by counter for their command type.
+func (self *senderThread) countLines(lines []string, counter func(counters *commandCounts) *uint64) {
+	for _, line := range lines {
+		var counters *commandCounts
+		switch lineCommandType(line) {
+		case SeriesCommandType:
+			counters = &self.counters.series
+		case PropertyCommandType:
+			counters = &self.counters.prop
+		case MessageCommandType:
+			counters = &self.counters.messages
+		default:
+			counters = &self.counters.entityTag
 		}
+		atomic.AddUint64(counter(counters), 1)
+	}
+}
+
+func (self *senderThread) pendingCount(commandType string) *uint64 {
+	switch commandType {
+	case SeriesCommandType:
+		return &self.pending.SeriesCommands
+	case PropertyCommandType:
+		return &self.pending.PropertyCommands
+	case MessageCommandType:
+		return &self.pending.MessageCommands
+	default:
+		return &self.pending.EntityTagCommands
+	}
+}
+
+// lineCommandType returns the command type of a network command line by its first word.
+func lineCommandType(line string) string {
+	switch {
+	case strings.HasPrefix(line, "series "):
+		return SeriesCommandType
+	case strings.HasPrefix(line, "property "):
+		return PropertyCommandType
+	case strings.HasPrefix(line, "message "):
+		return MessageCommandType
+	default:
+		return EntityTagCommandType
 	}
-	return
+}
+
+// rawCommand is a network command line passed to the dead-letter handler as is.
+type rawCommand string
+
+func (self rawCommand) String() string {
+	return string(self)
+}
+
+func (self *senderThread) drop() {
+	self.buffer.Reset()
+	atomic.AddUint64(&self.counters.series.dropped, self.pending.SeriesCommands)
+	atomic.AddUint64(&self.counters.prop.dropped, self.pending.PropertyCommands)
+	atomic.AddUint64(&self.counters.messages.dropped, self.pending.MessageCommands)
+	atomic.AddUint64(&self.counters.entityTag.dropped, self.pending.EntityTagCommands)
+	self.nc.undelivered.add(&self.pending)
+	self.nc.onDrop(&self.pending)
+	self.pending = UndeliveredError{}
+	self.written = nil
 }
 
 func (self *NetworkCommunicator) QueuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*atsdNet.EntityTagCommand, properties []*atsdNet.PropertyCommand, messageCommands []*atsdNet.MessageCommand) {
-	self.entityTag <- entityTagCommands
+	self.queuedSendData(seriesCommandsChunk, entityTagCommands, properties, messageCommands, nil)
+}
+
+func (self *NetworkCommunicator) queuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*atsdNet.EntityTagCommand, properties []*atsdNet.PropertyCommand, messageCommands []*atsdNet.MessageCommand, delivered func()) {
+	if !self.startQueueing() {
+		self.dropCommands(&self.undelivered, errCloseDeadline, seriesCommandsChunk, entityTagCommands, properties, messageCommands)
+		return
+	}
+	defer self.queueing.Done()
+	ack := newDeliveryAck(3+len(seriesCommandsChunk), delivered)
+
+	select {
+	case self.entityTag <- &queuedEntityTagCommands{commands: entityTagCommands, ack: ack}:
+	case <-self.abort:
+		self.dropCommands(&self.undelivered, errCloseDeadline, nil, entityTagCommands, nil, nil)
+	}
 
-	self.properties <- properties
+	select {
+	case self.properties <- &queuedPropertyCommands{commands: properties, ack: ack}:
+	case <-self.abort:
+		self.dropCommands(&self.undelivered, errCloseDeadline, nil, nil, properties, nil)
+	}
 
-	self.messageCommands <- messageCommands
+	select {
+	case self.messageCommands <- &queuedMessageCommands{commands: messageCommands, ack: ack}:
+	case <-self.abort:
+		self.dropCommands(&self.undelivered, errCloseDeadline, nil, nil, nil, messageCommands)
+	}
 
 	for _, val := range seriesCommandsChunk {
-		self.seriesCommandsChunkChan <- val
+		select {
+		case self.seriesCommandsChunkChan <- &queuedSeriesChunk{chunk: val, ack: ack}:
+		case <-self.abort:
+			self.dropCommands(&self.undelivered, errCloseDeadline, []*Chunk{val}, nil, nil, nil)
+		}
+	}
+}
+
+func (self *NetworkCommunicator) startQueueing() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed {
+		return false
+	}
+	self.queueing.Add(1)
+	return true
+}
+
+// sleep waits for d and returns false if the communicator is aborted in the meantime.
+func (self *NetworkCommunicator) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-self.abort:
+		return false
+	}
+}
+
+func (self *NetworkCommunicator) isAborted() bool {
+	select {
+	case <-self.abort:
+		return true
+	default:
+		return false
 	}
 }
 
+// Close stops accepting new data and waits until the sender goroutines have written
+// everything already queued. Whatever is still queued when ctx is done is dropped
+// and reported in the returned *UndeliveredError.
+func (self *NetworkCommunicator) Close(ctx context.Context) error {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return nil
+	}
+	self.closed = true
+	self.mutex.Unlock()
+
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(self.abort)
+			self.cancel()
+		case <-stopWatching:
+		}
+	}()
+
+	self.queueing.Wait()
+	close(self.quit)
+	self.senders.Wait()
+
+	for len(self.seriesCommandsChunkChan) > 0 {
+		self.dropCommands(&self.undelivered, errCloseDeadline, []*Chunk{(<-self.seriesCommandsChunkChan).chunk}, nil, nil, nil)
+	}
+	self.mutex.Lock()
+	self.isConnected = false
+	self.mutex.Unlock()
+	return self.undelivered.errorOrNil()
+}
+
+// PriorSendData writes the commands over a dedicated connection in one write, or
+// one datagram at a time for udp and unixgram endpoints.
 func (self *NetworkCommunicator) PriorSendData(seriesCommands []*atsdNet.SeriesCommand, entityTagCommands []*atsdNet.EntityTagCommand, propertyCommands []*atsdNet.PropertyCommand, messageCommands []*atsdNet.MessageCommand) {
-	conn, err := net.DialTimeout(self.protocol, self.hostport, 1*time.Second)
+	counts := map[string]int{
+		EntityTagCommandType: len(entityTagCommands),
+		PropertyCommandType:  len(propertyCommands),
+		SeriesCommandType:    len(seriesCommands),
+		MessageCommandType:   len(messageCommands),
+	}
+	buffer := &bytes.Buffer{}
+	for i := range entityTagCommands {
+		fmt.Fprint(buffer, entityTagCommands[i])
+	}
+	for i := range propertyCommands {
+		fmt.Fprint(buffer, propertyCommands[i])
+	}
+	for i := range seriesCommands {
+		fmt.Fprint(buffer, seriesCommands[i])
+	}
+	for i := range messageCommands {
+		fmt.Fprint(buffer, messageCommands[i])
+	}
+	if buffer.Len() == 0 {
+		return
+	}
+
+	index, endpoint := self.activeEndpoint()
+	conn, err := endpoint.open(self.ctx, 1*time.Second)
 	if err != nil {
-		glog.Error("Could not init connection to prior send self metrics ", err)
-		self.SetConnected(false)
+		self.log().Error("Could not init connection to prior send self metrics ", err)
+		self.reportFailure(index, err)
+		self.setConnected(false, err)
 		return
 	}
-	for i := range entityTagCommands {
-		_, err = fmt.Fprint(conn, entityTagCommands[i])
-		if err != nil {
-			glog.Error("Could not prior send entity-tag command ", err)
-			self.SetConnected(false)
+	defer conn.Close()
+	payloads := [][]byte{buffer.Bytes()}
+	if endpoint.isConnectionless() {
+		payloads, _ = packDatagrams(buffer.Bytes(), self.udpPayloadSize)
+	}
+	for _, payload := range payloads {
+		if _, err = conn.Write(payload); err != nil {
+			break
 		}
 	}
-	for i := range propertyCommands {
-		_, err = fmt.Fprint(conn, propertyCommands[i])
-		if err != nil {
-			glog.Error("Could not prior send property command ", err)
-			self.SetConnected(false)
+	if err != nil {
+		self.log().Error("Could not prior send self metrics ", err)
+		for commandType, count := range counts {
+			if count > 0 {
+				self.events().OnSendError(commandType, count, err)
+			}
 		}
+		self.setConnected(false, err)
+		return
 	}
-	for i := range seriesCommands {
-		_, err = fmt.Fprint(conn, seriesCommands[i])
-		if err != nil {
-			glog.Error("Could not prior send series command ", err)
-			self.SetConnected(false)
+	self.setConnected(true, nil)
+}
+
+// SendAndWait writes the batch over a dedicated connection. For the network
+// transports a command counts as sent once it is written to the socket.
+func (self *NetworkCommunicator) SendAndWait(ctx context.Context, batch *Batch) error {
+	batchError := BatchError{}
+	_, endpoint := self.activeEndpoint()
+	conn, err := endpoint.dial(ctx, 5*time.Second)
+	if err != nil {
+		self.setConnected(false, err)
+		for commandType, count := range map[string]int{
+			EntityTagCommandType: len(batch.EntityTagCommands),
+			PropertyCommandType:  len(batch.PropertyCommands),
+			SeriesCommandType:    len(batch.SeriesCommands),
+			MessageCommandType:   len(batch.MessageCommands),
+		} {
+			if count > 0 {
+				self.events().OnSendError(commandType, count, err)
+				batchError = append(batchError, newSendError(commandType, count, err))
+			}
 		}
+		return batchError
 	}
-	for i := range messageCommands {
-		_, err = fmt.Fprint(conn, messageCommands[i])
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		setWriteDeadline(conn, deadline)
+	}
+
+	send := func(commandType string, count int, writeCommands func(buffer *bytes.Buffer)) {
+		if count == 0 {
+			return
+		}
+		buffer := &bytes.Buffer{}
+		writeCommands(buffer)
+		payloads := [][]byte{buffer.Bytes()}
+		failed, err := 0, error(nil)
+		if endpoint.isConnectionless() {
+			var oversized [][]byte
+			payloads, oversized = packDatagrams(buffer.Bytes(), self.udpPayloadSize)
+			if failed = len(oversized); failed > 0 {
+				err = errors.New(fmt.Sprintf("%v commands are larger than the datagram payload size %v", failed, self.udpPayloadSize))
+			}
+		}
+		for _, payload := range payloads {
+			if _, writeErr := conn.Write(payload); writeErr != nil {
+				self.setConnected(false, writeErr)
+				failed, err = count, writeErr
+				break
+			}
+		}
 		if err != nil {
-			glog.Error("Could not prior send message command ", err)
-			self.SetConnected(false)
+			self.events().OnSendError(commandType, failed, err)
+			batchError = append(batchError, newSendError(commandType, failed, err))
+		}
+	}
+	send(EntityTagCommandType, len(batch.EntityTagCommands), func(buffer *bytes.Buffer) {
+		for i := range batch.EntityTagCommands {
+			fmt.Fprint(buffer, batch.EntityTagCommands[i])
+		}
+	})
+	send(PropertyCommandType, len(batch.PropertyCommands), func(buffer *bytes.Buffer) {
+		for i := range batch.PropertyCommands {
+			fmt.Fprint(buffer, batch.PropertyCommands[i])
+		}
+	})
+	send(SeriesCommandType, len(batch.SeriesCommands), func(buffer *bytes.Buffer) {
+		for i := range batch.SeriesCommands {
+			fmt.Fprint(buffer, batch.SeriesCommands[i])
 		}
+	})
+	send(MessageCommandType, len(batch.MessageCommands), func(buffer *bytes.Buffer) {
+		for i := range batch.MessageCommands {
+			fmt.Fprint(buffer, batch.MessageCommands[i])
+		}
+	})
+	return batchError.errorOrNil()
+}
+
+// packDatagrams splits newline-terminated commands into payloads of at most size
+// bytes without splitting a command, and returns the commands that are larger than size apart.
+func packDatagrams(commands []byte, size int) ([][]byte, [][]byte) {
+	datagrams := [][]byte{}
+	oversized := [][]byte{}
+	datagram := []byte{}
+	for _, command := range bytes.SplitAfter(commands, []byte("\n")) {
+		if len(command) == 0 {
+			continue
+		}
+		if len(command) > size {
+			oversized = append(oversized, command)
+			continue
+		}
+		if len(datagram)+len(command) > size {
+			datagrams = append(datagrams, datagram)
+			datagram = []byte{}
+		}
+		datagram = append(datagram, command...)
 	}
-	conn.Close()
+	if len(datagram) > 0 {
+		datagrams = append(datagrams, datagram)
+	}
+	return datagrams, oversized
 }
 
 func (self *NetworkCommunicator) SetConnected(isConnected bool) {
+	self.setConnected(isConnected, nil)
+}
+
+// setConnected updates the connection state and tells the listener when it changes.
+func (self *NetworkCommunicator) setConnected(isConnected bool, err error) {
 	self.mutex.Lock()
-	defer self.mutex.Unlock()
+	changed := self.isConnected != isConnected
 	self.isConnected = isConnected
+	self.mutex.Unlock()
+	if _, endpoint := self.activeEndpoint(); changed && isConnected {
+		self.events().OnConnect(endpoint.String())
+	} else if changed {
+		self.events().OnDisconnect(endpoint.String(), err)
+	}
+}
+
+func (self *NetworkCommunicator) activeEndpoint() (int, *endpoint) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.active, self.endpoints[self.active]
+}
+
+// reportFailure counts a failed dial or write to the endpoint with the given index.
+// After failoverThreshold consecutive failures of the active endpoint it switches
+// to the next one and returns true.
+func (self *NetworkCommunicator) reportFailure(index int, err error) bool {
+	self.mutex.Lock()
+	if len(self.endpoints) == 1 || index != self.active {
+		self.mutex.Unlock()
+		return false
+	}
+	self.failures++
+	if self.failures < self.failoverThreshold {
+		self.mutex.Unlock()
+		return false
+	}
+	self.failures = 0
+	self.active = (self.active + 1) % len(self.endpoints)
+	next := self.endpoints[self.active]
+	self.mutex.Unlock()
+	self.log().Warning("Failing over from ", self.endpoints[index], " to ", next, " after error: ", err)
+	return true
+}
+
+func (self *NetworkCommunicator) reportSuccess(index int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if index == self.active {
+		self.failures = 0
+	}
+}
+
+// probePrimary checks the primary endpoint every probeInterval while another
+// endpoint is active and fails back once the primary accepts connections.
+// A connectionless primary is not probed, dialing it always succeeds.
+func (self *NetworkCommunicator) probePrimary() {
+	for {
+		select {
+		case <-time.After(self.probeInterval):
+		case <-self.quit:
+			return
+		}
+		if active, _ := self.activeEndpoint(); active == 0 {
+			continue
+		}
+		conn, err := self.endpoints[0].dial(self.ctx, 5*time.Second)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		self.mutex.Lock()
+		self.active = 0
+		self.failures = 0
+		self.mutex.Unlock()
+		self.log().Info("Failing back to ", self.endpoints[0])
+	}
 }
 
 func (self *NetworkCommunicator) IsConnected() bool {
@@ -249,14 +841,29 @@ func (self *NetworkCommunicator) IsConnected() bool {
 }
 
 func (self *NetworkCommunicator) SelfMetricValues() []*metricValue {
+	active, activeEndpoint := self.activeEndpoint()
+	transport := activeEndpoint.url.Scheme
 	metricValues := []*metricValue{}
+	if len(self.endpoints) > 1 {
+		for i, endpoint := range self.endpoints {
+			isActive := int64(0)
+			if i == active {
+				isActive = 1
+			}
+			metricValues = append(metricValues, &metricValue{
+				name:  "endpoint.active",
+				tags:  map[string]string{"endpoint": endpoint.String()},
+				value: atsdNet.Int64(isActive),
+			})
+		}
+	}
 	for i := range self.counters {
 		metricValues = append(metricValues,
 			&metricValue{
 				name: "series-commands.sent",
 				tags: map[string]string{
 					"thread":    strconv.FormatInt(int64(i), 10),
-					"transport": self.protocol,
+					"transport": transport,
 				},
 				value: atsdNet.Int64(atomic.LoadUint64(&self.counters[i].series.sent)),
 			},
@@ -264,7 +871,7 @@ func (self *NetworkCommunicator) SelfMetricValues() []*metricValue {
 				name: "series-commands.dropped",
 				tags: map[string]string{
 					"thread":    strconv.FormatInt(int64(i), 10),
-					"transport": self.protocol,
+					"transport": transport,
 				},
 				value: atsdNet.Int64(atomic.LoadUint64(&self.counters[i].series.dropped)),
 			},
@@ -272,7 +879,7 @@ func (self *NetworkCommunicator) SelfMetricValues() []*metricValue {
 				name: "message-commands.sent",
 				tags: map[string]string{
 					"thread":    strconv.FormatInt(int64(i), 10),
-					"transport": self.protocol,
+					"transport": transport,
 				},
 				value: atsdNet.Int64(atomic.LoadUint64(&self.counters[i].messages.sent)),
 			},
@@ -280,7 +887,7 @@ func (self *NetworkCommunicator) SelfMetricValues() []*metricValue {
 				name: "message-commands.dropped",
 				tags: map[string]string{
 					"thread":    strconv.FormatInt(int64(i), 10),
-					"transport": self.protocol,
+					"transport": transport,
 				},
 				value: atsdNet.Int64(atomic.LoadUint64(&self.counters[i].messages.dropped)),
 			},
@@ -288,7 +895,7 @@ func (self *NetworkCommunicator) SelfMetricValues() []*metricValue {
 				name: "property-commands.sent",
 				tags: map[string]string{
 					"thread":    strconv.FormatInt(int64(i), 10),
-					"transport": self.protocol,
+					"transport": transport,
 				},
 				value: atsdNet.Int64(atomic.LoadUint64(&self.counters[i].prop.sent)),
 			},
@@ -296,7 +903,7 @@ func (self *NetworkCommunicator) SelfMetricValues() []*metricValue {
 				name: "property-commands.dropped",
 				tags: map[string]string{
 					"thread":    strconv.FormatInt(int64(i), 10),
-					"transport": self.protocol,
+					"transport": transport,
 				},
 				value: atsdNet.Int64(atomic.LoadUint64(&self.counters[i].prop.dropped)),
 			},
@@ -304,7 +911,7 @@ func (self *NetworkCommunicator) SelfMetricValues() []*metricValue {
 				name: "entitytag-commands.sent",
 				tags: map[string]string{
 					"thread":    strconv.FormatInt(int64(i), 10),
-					"transport": self.protocol,
+					"transport": transport,
 				},
 				value: atsdNet.Int64(atomic.LoadUint64(&self.counters[i].entityTag.sent)),
 			},
@@ -312,7 +919,7 @@ func (self *NetworkCommunicator) SelfMetricValues() []*metricValue {
 				name: "entitytag-commands.dropped",
 				tags: map[string]string{
 					"thread":    strconv.FormatInt(int64(i), 10),
-					"transport": self.protocol,
+					"transport": transport,
 				},
 				value: atsdNet.Int64(atomic.LoadUint64(&self.counters[i].entityTag.dropped)),
 			},
@@ -0,0 +1,519 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	atsdNet "github.com/axibase/atsd-api-go/net"
+)
+
+// listenCommandApi starts a server accepting gzip-compressed commands on the ATSD command API.
+func listenCommandApi(t *testing.T) (*httptest.Server, chan string, *int32) {
+	lines := make(chan string, 1000)
+	requests := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/command" {
+			return
+		}
+		atomic.AddInt32(requests, 1)
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Error("commands are not compressed")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}))
+	return server, lines, requests
+}
+
+func TestNetworkCommunicatorFailover(t *testing.T) {
+	primary, primaryLines := listenCommands(t)
+	primaryAddress := primary.Addr().String()
+	primary.Close()
+
+	failover, failoverLines, _ := listenCommandApi(t)
+	defer failover.Close()
+	failoverUrl, _ := url.Parse(failover.URL)
+
+	config := GetDefaultConfig()
+	config.Url = &url.URL{Scheme: "tcp", Host: primaryAddress}
+	config.FailoverUrls = []*url.URL{failoverUrl}
+	config.FailoverThreshold = 1
+	config.FailbackProbeInterval = 50 * time.Millisecond
+	communicator, err := newNetworkCommunicator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer communicator.Close(context.Background())
+
+	communicator.QueuedSendData(seriesCommandsToChunks(seriesCommands("entity001", 1)), nil, nil, nil)
+	select {
+	case <-failoverLines:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command was not sent to the failover endpoint")
+	}
+	if active, _ := communicator.activeEndpoint(); active != 1 {
+		t.Error("unexpected active endpoint: ", active)
+	}
+
+	primary, err = net.Listen("tcp", primaryAddress)
+	if err != nil {
+		t.Skip("could not listen on the primary address again: ", err)
+	}
+	go func() {
+		for {
+			conn, err := primary.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					primaryLines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	defer primary.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for active, _ := communicator.activeEndpoint(); active != 0; active, _ = communicator.activeEndpoint() {
+		if time.Now().After(deadline) {
+			t.Fatal("did not fail back to the primary endpoint")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	communicator.QueuedSendData(seriesCommandsToChunks(seriesCommands("entity001", 1)), nil, nil, nil)
+	select {
+	case <-primaryLines:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command was not sent to the primary endpoint after failback")
+	}
+}
+
+func TestNetworkCommunicatorNoFailbackToDatagrams(t *testing.T) {
+	failover, _ := listenCommands(t)
+	defer failover.Close()
+
+	config := GetDefaultConfig()
+	config.Url = &url.URL{Scheme: "udp", Host: "127.0.0.1:9"}
+	config.FailoverUrls = []*url.URL{{Scheme: "tcp", Host: failover.Addr().String()}}
+	config.FailoverThreshold = 1
+	config.FailbackProbeInterval = 10 * time.Millisecond
+	communicator, err := newNetworkCommunicator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer communicator.Close(context.Background())
+
+	communicator.reportFailure(0, errors.New("connection refused"))
+	time.Sleep(100 * time.Millisecond)
+	if active, _ := communicator.activeEndpoint(); active != 1 {
+		t.Error("failed back to the udp primary without knowing it is up")
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its key to dir.
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "atsd"},
+		DNSNames:              []string{"atsd.local"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestNetworkCommunicatorTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(mustReadFile(t, certFile))
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	lines := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	config := GetDefaultConfig()
+	config.Url = &url.URL{Scheme: "tls", Host: listener.Addr().String()}
+	config.TLSCAFile = certFile
+	config.TLSCertFile = certFile
+	config.TLSKeyFile = keyFile
+	config.TLSServerName = "atsd.local"
+	storage, err := NewFactoryFromConfig(config).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.QueuedSendSeriesCommands("", seriesCommands("entity001", 2))
+	storage.writeCommunicator.PriorSendData(seriesCommands("entity002", 1), nil, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-lines:
+		case <-time.After(5 * time.Second):
+			t.Fatal("only ", i, " commands received over tls")
+		}
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestNetworkCommunicatorUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "relay.sock")
+
+	for _, network := range []string{"unix", "unixgram"} {
+		os.Remove(path)
+		lines := make(chan string, 100)
+		var closer interface{ Close() error }
+		if network == "unix" {
+			listener, err := net.Listen(network, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			closer = listener
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						scanner := bufio.NewScanner(conn)
+						for scanner.Scan() {
+							lines <- scanner.Text()
+						}
+					}()
+				}
+			}()
+		} else {
+			conn, err := net.ListenPacket(network, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			closer = conn
+			go func() {
+				datagram := make([]byte, 65536)
+				for {
+					n, _, err := conn.ReadFrom(datagram)
+					if err != nil {
+						return
+					}
+					scanner := bufio.NewScanner(bytes.NewReader(datagram[:n]))
+					for scanner.Scan() {
+						lines <- scanner.Text()
+					}
+				}
+			}()
+		}
+
+		config := GetDefaultConfig()
+		config.Url = &url.URL{Scheme: network, Path: path}
+		storage, err := NewFactoryFromConfig(config).Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.QueuedSendSeriesCommands("", seriesCommands("entity001", 2))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(network, ": ", err)
+		}
+		cancel()
+		for i := 0; i < 2; i++ {
+			select {
+			case <-lines:
+			case <-time.After(5 * time.Second):
+				t.Fatal("only ", i, " commands received over ", network)
+			}
+		}
+		closer.Close()
+	}
+}
+
+func TestNetworkCommunicatorDatagramPacking(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixgram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, url := range []*url.URL{
+		{Scheme: "udp", Host: "127.0.0.1:0"},
+		{Scheme: "unixgram", Path: filepath.Join(dir, "relay.sock")},
+	} {
+		conn, err := net.ListenPacket(url.Scheme, url.Host+url.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if url.Scheme == "udp" {
+			url.Host = conn.LocalAddr().String()
+		}
+		datagrams := make(chan []byte, 100)
+		go func() {
+			for {
+				datagram := make([]byte, 65536)
+				n, _, err := conn.ReadFrom(datagram)
+				if err != nil {
+					return
+				}
+				datagrams <- datagram[:n]
+			}
+		}()
+
+		config := GetDefaultConfig()
+		config.Url = url
+		config.UdpPayloadSize = 200
+		communicator, err := newNetworkCommunicator(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands := seriesCommands("entity001", 10)
+		commands = append(commands, seriesCommands(strings.Repeat("e", 300), 1)...)
+		communicator.QueuedSendData(seriesCommandsToChunks(commands), nil, nil, nil)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := communicator.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+
+		received := 0
+		for received < 10 {
+			select {
+			case datagram := <-datagrams:
+				if len(datagram) > 200 {
+					t.Error(url.Scheme, ": datagram of ", len(datagram), " bytes exceeds the payload size")
+				}
+				if !bytes.HasSuffix(datagram, []byte("\n")) {
+					t.Error(url.Scheme, ": command was split between datagrams: ", string(datagram))
+				}
+				received += bytes.Count(datagram, []byte("\n"))
+			case <-time.After(5 * time.Second):
+				t.Fatal(url.Scheme, ": only ", received, " commands received")
+			}
+		}
+		if dropped := atomic.LoadUint64(&communicator.counters[0].series.dropped); dropped != 1 {
+			t.Error(url.Scheme, ": oversized command was not counted as dropped: ", dropped)
+		}
+		conn.Close()
+	}
+}
+
+func TestNetworkCommunicatorCommandApi(t *testing.T) {
+	server, lines, requests := listenCommandApi(t)
+	defer server.Close()
+
+	config := GetDefaultConfig()
+	config.Url, _ = url.Parse(server.URL + "/?mode=commands")
+	storage, err := NewFactoryFromConfig(config).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storage.writeCommunicator.(*NetworkCommunicator); !ok {
+		t.Fatal("mode=commands did not select the network communicator")
+	}
+	for i := 0; i < 100; i++ {
+		storage.QueuedSendSeriesCommands("", seriesCommands(fmt.Sprint("entity", i), 1))
+	}
+	storage.QueuedSendMessageCommands([]*atsdNet.MessageCommand{atsdNet.NewMessageCommand("entity001", "message001")})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 101 {
+		t.Error("unexpected number of commands received: ", len(lines))
+	}
+	if count := atomic.LoadInt32(requests); count > 3 {
+		t.Error("commands were not batched, requests: ", count)
+	}
+}
+
+func TestNetworkCommunicatorPriorSendDataCommandApi(t *testing.T) {
+	server, lines, requests := listenCommandApi(t)
+	defer server.Close()
+
+	config := GetDefaultConfig()
+	config.Url, _ = url.Parse(server.URL + "/?mode=commands")
+	communicator, err := newNetworkCommunicator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer communicator.Close(context.Background())
+	properties := []*atsdNet.PropertyCommand{atsdNet.NewPropertyCommand("disk", "entity001", "size", "100")}
+	communicator.PriorSendData(seriesCommands("entity001", 10), nil, properties, nil)
+	if len(lines) != 11 {
+		t.Error("unexpected number of commands received: ", len(lines))
+	}
+	if count := atomic.LoadInt32(requests); count != 1 {
+		t.Error("self metrics were not posted in one request: ", count)
+	}
+}
+
+func TestNetworkCommunicatorCloseCancelsCommandApiPost(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	serverUrl, _ := url.Parse(server.URL + "/?mode=commands")
+	communicator, err := NewNetworkCommunicator(1, serverUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	communicator.QueuedSendData(seriesCommandsToChunks(seriesCommands("entity001", 1)), nil, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = communicator.Close(ctx)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("Close waited for the post in progress: ", elapsed)
+	}
+	if undelivered, ok := err.(*UndeliveredError); !ok || undelivered.SeriesCommands != 1 {
+		t.Error("expected the posted command to be undelivered, got ", err)
+	}
+}
+
+func TestNetworkCommunicatorCommandApiRejectsBadRequest(t *testing.T) {
+	lines := make(chan string, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/command" {
+			return
+		}
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(reader)
+		if strings.Contains(string(body), "invalid") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, line := range strings.SplitAfter(strings.TrimSuffix(string(body), "\n"), "\n") {
+			lines <- line
+		}
+	}))
+	defer server.Close()
+
+	serverUrl, _ := url.Parse(server.URL + "/?mode=commands")
+	communicator, err := NewNetworkCommunicator(1, serverUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters := &recordingDeadLetters{}
+	communicator.SetDeadLetterHandler(deadLetters)
+	communicator.QueuedSendData(seriesCommandsToChunks(invalidSeries(5, 3)), nil, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := communicator.Close(ctx); err != nil {
+		t.Fatal("the rejected post was retried: ", err)
+	}
+
+	if len(deadLetters.rejected) != 1 || !strings.HasPrefix(deadLetters.rejected[0], "series series e:invalid ") {
+		t.Error("unexpected rejected commands: ", deadLetters.rejected)
+	}
+	if len(lines) != 4 {
+		t.Error("unexpected number of commands received: ", len(lines))
+	}
+	if sent, dropped := atomic.LoadUint64(&communicator.counters[0].series.sent), atomic.LoadUint64(&communicator.counters[0].series.dropped); sent != 4 || dropped != 1 {
+		t.Error("unexpected counters, sent: ", sent, " dropped: ", dropped)
+	}
+}
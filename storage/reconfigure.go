@@ -0,0 +1,189 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// reconfigurableFields are the Config fields Reconfigure applies to the running Storage.
+var reconfigurableFields = map[string]bool{
+	"GroupParams":             true,
+	"DeduplicationRules":      true,
+	"MetadataRefreshInterval": true,
+	"UpdateInterval":          true,
+	"Listener":                true,
+	"DeadLetterHandler":       true,
+}
+
+// transportFields are the Config fields Reconfigure applies by replacing the write communicator.
+var transportFields = map[string]bool{
+	"Url":                   true,
+	"FailoverUrls":          true,
+	"FailoverThreshold":     true,
+	"FailbackProbeInterval": true,
+	"UdpPayloadSize":        true,
+	"HttpMaxBatchSize":      true,
+	"ReplicaUrls":           true,
+	"SenderGoroutineLimit":  true,
+	"Username":              true,
+	"PasswordFile":          true,
+	"PasswordEnv":           true,
+	"BearerToken":           true,
+	"BearerTokenFile":       true,
+	"InsecureSkipVerify":    true,
+	"TLSCAFile":             true,
+	"TLSCertFile":           true,
+	"TLSKeyFile":            true,
+	"TLSServerName":         true,
+	"DeadLetterFile":        true,
+}
+
+// Reconfigure applies config to the running Storage. Deduplication groups and rules
+// are swapped keeping the last sent samples of the groups that stay, and periodic
+// sending is rescheduled with the new UpdateInterval.
+//
+// Changes of the destination, credentials or other transport settings need a new
+// write communicator and are rejected unless allowTransportRebuild is set. Then the
+// new communicator takes over and the old one is closed with ctx, delivering what
+// it had queued; its *UndeliveredError is returned. Memstore, write-ahead log,
+// spillover and self-metric settings cannot be changed without recreating Storage.
+func (self *Storage) Reconfigure(ctx context.Context, config Config, allowTransportRebuild bool) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	oldCommunicator, oldDeadLetters, err := self.reconfigure(ctx, config, allowTransportRebuild)
+	if err != nil {
+		return err
+	}
+	// The old communicator may be stuck on an unreachable ATSD until ctx is done,
+	// so it is closed without holding any lock.
+	if oldCommunicator != nil {
+		err = oldCommunicator.Close(ctx)
+	}
+	if oldDeadLetters != nil {
+		if deadLettersErr := oldDeadLetters.Close(); deadLettersErr != nil && err == nil {
+			err = deadLettersErr
+		}
+	}
+	return err
+}
+
+// reconfigure applies config and returns the write communicator and the
+// dead-letter sink it replaced, if any, for the caller to close. A sink that
+// stays in use is not returned.
+func (self *Storage) reconfigure(ctx context.Context, config Config, allowTransportRebuild bool) (transport, DeadLetterSink, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	rebuildTransport := false
+	deadLettersChanged := false
+	fixed := []string{}
+	for _, field := range configChanges(self.config, config) {
+		if field == "DeadLetterHandler" || field == "DeadLetterFile" {
+			deadLettersChanged = true
+		}
+		switch {
+		case reconfigurableFields[field]:
+		case transportFields[field]:
+			rebuildTransport = true
+		default:
+			fixed = append(fixed, field)
+		}
+	}
+	if len(fixed) > 0 {
+		return nil, nil, fmt.Errorf("%v cannot be changed without recreating Storage", strings.Join(fixed, ", "))
+	}
+	if rebuildTransport && !allowTransportRebuild {
+		return nil, nil, fmt.Errorf("the new config requires rebuilding the write communicator")
+	}
+	if rebuildTransport && self.newTransport == nil {
+		return nil, nil, fmt.Errorf("the write communicator of this Storage cannot be rebuilt")
+	}
+
+	rules, err := compileRules(config.DeduplicationRules)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The sink set by SetDeadLetterSink stays until config changes the dead-letter settings.
+	newConfig := config
+	if !deadLettersChanged {
+		config = self.withDeadLetterSink(config)
+	}
+
+	var oldCommunicator transport
+	var oldDeadLetters DeadLetterSink
+	if rebuildTransport {
+		writeCommunicator, err := self.newTransport(config)
+		if err != nil {
+			return nil, nil, err
+		}
+		deadLetters, err := setUpWriteCommunicator(config, writeCommunicator, self.journal)
+		if err != nil {
+			writeCommunicator.Close(ctx)
+			return nil, nil, err
+		}
+		// Nothing holds transportMutex while it waits for ATSD, swapping never blocks.
+		self.transportMutex.Lock()
+		oldCommunicator, oldDeadLetters = self.writeCommunicator, self.deadLetters
+		self.writeCommunicator, self.deadLetters = writeCommunicator, deadLetters
+		self.transportMutex.Unlock()
+	} else {
+		writeCommunicator := self.communicator()
+		writeCommunicator.SetListener(config.Listener)
+		if config.DeadLetterFile == "" {
+			writeCommunicator.SetDeadLetterHandler(self.journal.filter(config.DeadLetterHandler))
+			sink, _ := config.DeadLetterHandler.(DeadLetterSink)
+			self.transportMutex.Lock()
+			oldDeadLetters, self.deadLetters = self.deadLetters, sink
+			self.transportMutex.Unlock()
+		}
+	}
+	if isSameHandler(oldDeadLetters, self.deadLetters) {
+		oldDeadLetters = nil
+	}
+	self.setListeners(config, self.deadLetters)
+
+	self.dataCompacter.SetGroupParams(config.GroupParams)
+	self.dataCompacter.setRules(rules)
+	self.metadataCompacter.SetRefreshInterval(config.MetadataRefreshInterval)
+	if config.UpdateInterval != self.updateInterval {
+		self.updateInterval = config.UpdateInterval
+		if self.isUpdating {
+			// The task already ran on the old schedule, the next run is one interval away.
+			close(self.stopUpdateTask)
+			self.stopUpdateTask = scheduleEvery(self.updateTask, self.updateInterval, false)
+		}
+	}
+	self.config = newConfig
+	self.deadLetterSinkSet = self.deadLetterSinkSet && !deadLettersChanged
+	return oldCommunicator, oldDeadLetters, nil
+}
+
+// configChanges returns the names of the fields that differ between the configs.
+func configChanges(old, new Config) []string {
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	changes := []string{}
+	for i := 0; i < oldValue.NumField(); i++ {
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changes = append(changes, oldValue.Type().Field(i).Name)
+		}
+	}
+	return changes
+}
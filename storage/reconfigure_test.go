@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+func TestStorageReconfigure(t *testing.T) {
+	config := GetDefaultConfig()
+	config.GroupParams = map[string]DeduplicationParams{
+		"cpu":  {Threshold: Absolute(10), Interval: time.Hour},
+		"disk": {Threshold: Absolute(10), Interval: time.Hour},
+	}
+	memstore, _ := NewMemStore(minMemoryLimit)
+	storage, err := newStorage(config, memstore, &fakeCommunicator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := func(value float64, ms int64) int {
+		accepted, _ := storage.QueuedSendSeriesCommands("cpu", []*net.SeriesCommand{
+			net.NewSeriesCommand("entity001", "cpu_busy", net.Float64(value)).SetTimestamp(net.Millis(ms)),
+		})
+		return accepted
+	}
+	if cpu(50, 1000) != 1 {
+		t.Fatal("first sample was not sent")
+	}
+
+	reconfigured := config
+	reconfigured.GroupParams = map[string]DeduplicationParams{"cpu": {Threshold: Absolute(5), Interval: time.Hour}}
+	reconfigured.UpdateInterval = 10 * time.Second
+	if err := storage.Reconfigure(context.Background(), reconfigured, false); err != nil {
+		t.Fatal(err)
+	}
+	if cpu(53, 2000) != 0 {
+		t.Error("last sent sample of the kept group was lost")
+	}
+	if cpu(56, 3000) != 1 {
+		t.Error("new threshold was not applied")
+	}
+	if _, ok := storage.dataCompacter.buffer["disk"]; ok || storage.updateInterval != 10*time.Second {
+		t.Error("removed group was kept or update interval was not changed")
+	}
+
+	moved := reconfigured
+	moved.Url, _ = url.Parse("tcp://atsd-2:8081")
+	if err := storage.Reconfigure(context.Background(), moved, false); err == nil || !strings.Contains(err.Error(), "rebuilding") {
+		t.Errorf("expected the transport change to be rejected, got %v", err)
+	}
+	resized := reconfigured
+	resized.MemstoreLimit = 2 * minMemoryLimit
+	if err := storage.Reconfigure(context.Background(), resized, true); err == nil || !strings.Contains(err.Error(), "MemstoreLimit") {
+		t.Errorf("expected the memstore change to be rejected, got %v", err)
+	}
+
+	rebuilt := &fakeCommunicator{}
+	storage.newTransport = func(config Config) (transport, error) {
+		if config.Url.Host != "atsd-2:8081" {
+			t.Error("transport was built from the old config")
+		}
+		return rebuilt, nil
+	}
+	if err := storage.Reconfigure(context.Background(), moved, true); err != nil {
+		t.Fatal(err)
+	}
+	if storage.writeCommunicator != rebuilt {
+		t.Error("write communicator was not replaced")
+	}
+	storage.ForceSend()
+	if len(rebuilt.batches) != 1 || len(rebuilt.batches[0]) != 2 {
+		t.Errorf("queued commands were not sent through the new communicator: %v", rebuilt.batches)
+	}
+}
+
+func TestStorageReconfigureWhileSendingBlocks(t *testing.T) {
+	listener, _ := listenCommands(t)
+	address := listener.Addr().String()
+	listener.Close()
+
+	config := GetDefaultConfig()
+	config.Url = &url.URL{Scheme: "tcp", Host: address}
+	config.UpdateInterval = 50 * time.Millisecond
+	storage, err := NewFactoryFromConfig(config).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.StartPeriodicSending()
+	for i := 0; i < 3; i++ {
+		storage.QueuedSendMessageCommands([]*net.MessageCommand{net.NewMessageCommand("entity001", "message001")})
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	listener, lines := listenCommands(t)
+	defer listener.Close()
+	moved := config
+	moved.Url = &url.URL{Scheme: "tcp", Host: listener.Addr().String()}
+	moved.UpdateInterval = 20 * time.Millisecond
+	reconfigured := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		reconfigured <- storage.Reconfigure(ctx, moved, true)
+	}()
+	select {
+	case err := <-reconfigured:
+		if _, ok := err.(*UndeliveredError); !ok {
+			t.Error("unexpected error: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reconfigure did not return after its deadline")
+	}
+
+	storage.QueuedSendMessageCommands([]*net.MessageCommand{net.NewMessageCommand("entity001", "message002")})
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, "message002") {
+				storage.Close(context.Background())
+				return
+			}
+		case <-deadline:
+			t.Fatal("data was not sent through the new communicator")
+		}
+	}
+}
+
+func TestStorageReconfigureUpdateIntervalKeepsSchedule(t *testing.T) {
+	config := GetDefaultConfig()
+	config.UpdateInterval = time.Hour
+	memstore, _ := NewMemStore(minMemoryLimit)
+	communicator := &fakeCommunicator{}
+	storage, err := newStorage(config, memstore, communicator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close(context.Background())
+	storage.StartPeriodicSending()
+	defer storage.StopPeriodicSending()
+	time.Sleep(100 * time.Millisecond)
+	storage.QueuedSendSeriesCommands("", []*net.SeriesCommand{net.NewSeriesCommand("entity001", "cpu_busy", net.Float64(1))})
+
+	reconfigured := config
+	reconfigured.UpdateInterval = 2 * time.Hour
+	if err := storage.Reconfigure(context.Background(), reconfigured, false); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	communicator.Lock()
+	defer communicator.Unlock()
+	for _, batch := range communicator.batches {
+		if len(batch) > 0 {
+			t.Error("changing the update interval sent the queued commands before the interval passed")
+		}
+	}
+}
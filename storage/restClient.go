@@ -0,0 +1,126 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/url"
+
+	"github.com/axibase/atsd-api-go/http"
+)
+
+const (
+	seriesInsertPath     = "/api/v1/series/insert"
+	propertiesInsertPath = "/api/v1/properties/insert"
+	messagesInsertPath   = "/api/v1/messages/insert"
+	entitiesPath         = "/api/v1/entities/"
+)
+
+// httpApiClient calls the part of the ATSD REST API used by the http communicator
+// with a net/http client configured by newHttpApiClient, which takes the TLS
+// settings and credentials from the config.
+type httpApiClient struct {
+	url         *url.URL
+	client      *nethttp.Client
+	credentials *credentials
+}
+
+// newHttpApiClient creates the client of atsdUrl. Its requests are authorized
+// by an authorizingTransport, so the password never becomes part of a url.
+func newHttpApiClient(config Config, atsdUrl *url.URL) (*httpApiClient, error) {
+	credentials, err := newCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	transport := &authorizingTransport{
+		transport:   &nethttp.Transport{TLSClientConfig: tlsConfig},
+		credentials: credentials,
+		url:         atsdUrl,
+	}
+	withoutUser := *atsdUrl
+	withoutUser.User = nil
+	return &httpApiClient{
+		url:         &withoutUser,
+		client:      &nethttp.Client{Transport: transport, Timeout: commandPostTimeout},
+		credentials: credentials,
+	}, nil
+}
+
+func (self *httpApiClient) Url() *url.URL {
+	return self.url
+}
+func (self *httpApiClient) insertSeries(ctx context.Context, series []*http.Series) error {
+	return self.send(ctx, "POST", seriesInsertPath, series)
+}
+func (self *httpApiClient) insertProperties(ctx context.Context, properties []*http.Property) error {
+	return self.send(ctx, "POST", propertiesInsertPath, properties)
+}
+func (self *httpApiClient) insertMessages(ctx context.Context, messages []*http.Message) error {
+	return self.send(ctx, "POST", messagesInsertPath, messages)
+}
+func (self *httpApiClient) updateEntity(ctx context.Context, entity string, tags map[string]string) error {
+	return self.send(ctx, "PATCH", entitiesPath+url.PathEscape(entity), map[string]interface{}{"tags": tags})
+}
+func (self *httpApiClient) createEntity(ctx context.Context, entity string, tags map[string]string) error {
+	return self.send(ctx, "PUT", entitiesPath+url.PathEscape(entity), map[string]interface{}{"tags": tags})
+}
+
+// send makes a request with the JSON encoded body, which is canceled once ctx is
+// done. A response other than 2xx is returned as a *StatusError.
+func (self *httpApiClient) send(ctx context.Context, method, path string, body interface{}) error {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := nethttp.NewRequest(method, apiBaseUrl(self.url)+path, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := self.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return &StatusError{Code: response.StatusCode, Status: response.Status, Request: method + " " + path}
+	}
+	return nil
+}
+
+// authorizingTransport sets the Authorization header of every request, see credentials.authorize.
+type authorizingTransport struct {
+	transport   nethttp.RoundTripper
+	credentials *credentials
+	url         *url.URL
+}
+
+func (self *authorizingTransport) RoundTrip(request *nethttp.Request) (*nethttp.Response, error) {
+	// A RoundTripper must not modify the request it was given.
+	authorized := request.Clone(request.Context())
+	self.credentials.authorize(authorized, self.url)
+	return self.transport.RoundTrip(authorized)
+}
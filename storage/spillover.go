@@ -0,0 +1,404 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+type spillSegment struct {
+	size     int64
+	commands int
+	// counts are the commands of every type, reported to the listener if the segment is discarded.
+	counts   UndeliveredError
+	created  time.Time
+	inFlight bool
+}
+
+// Spillover stores released data that could not be handed to a disconnected
+// write communicator. Every spilled batch becomes one segment file; segments are
+// requeued oldest first and removed once delivered, or discarded when the
+// total size or the age of a segment exceeds the configured bounds.
+type Spillover struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	next     uint64
+	segments map[uint64]*spillSegment
+	dropped  uint64
+	// unreported counts the discarded commands not yet passed to listener.
+	unreported UndeliveredError
+	listener   listenerHolder
+	// requeued holds the commands of every segment handed to a write communicator
+	// and not delivered yet, see isRequeued.
+	requeued         map[uint64][]interface{}
+	requeuedCommands map[interface{}]bool
+
+	sync.Mutex
+}
+
+// OpenSpillover opens the spillover directory, picking up segments left by a previous run.
+// A zero maxSize or maxAge disables the corresponding bound.
+func OpenSpillover(dir string, maxSize ByteSize, maxAge time.Duration) (*Spillover, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	removeStaleTmpFiles(dir)
+	segments, err := listLogSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	spillover := &Spillover{
+		dir:              dir,
+		maxSize:          int64(maxSize),
+		maxAge:           maxAge,
+		segments:         map[uint64]*spillSegment{},
+		requeued:         map[uint64][]interface{}{},
+		requeuedCommands: map[interface{}]bool{},
+	}
+	for _, segment := range segments {
+		path := logSegmentPath(dir, segment)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		spillSegment := &spillSegment{size: info.Size(), created: info.ModTime()}
+		spillSegment.commands, _ = readLogFile(path, func(command interface{}) {
+			switch command.(type) {
+			case *net.SeriesCommand:
+				spillSegment.counts.SeriesCommands++
+			case *net.EntityTagCommand:
+				spillSegment.counts.EntityTagCommands++
+			case *net.PropertyCommand:
+				spillSegment.counts.PropertyCommands++
+			case *net.MessageCommand:
+				spillSegment.counts.MessageCommands++
+			}
+		})
+		spillover.segments[segment] = spillSegment
+		spillover.next = segment + 1
+	}
+	return spillover, nil
+}
+
+// staleTmpAge is the age after which a temporary segment file is left by a crash,
+// younger ones may still be written by a Spillover replaced by Reconfigure.
+const staleTmpAge = time.Minute
+
+// removeStaleTmpFiles removes the temporary files of writeLogFile left by a crash.
+func removeStaleTmpFiles(dir string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, logSegmentPrefix+"*"+logSegmentSuffix+".tmp"))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleTmpAge {
+			os.Remove(path)
+		}
+	}
+}
+
+// Spill writes the batch to a new segment. The series chunks are left untouched.
+func (self *Spillover) Spill(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand) error {
+	records := []*logRecord{}
+	for _, chunk := range seriesCommandsChunk {
+		for el := chunk.Front(); el != nil; el = el.Next() {
+			records = append(records, seriesCommandToLogRecord(el.Value.(*net.SeriesCommand)))
+		}
+	}
+	for i := range entityTagCommands {
+		records = append(records, entityTagCommandToLogRecord(entityTagCommands[i]))
+	}
+	for i := range propertyCommands {
+		records = append(records, propertyCommandToLogRecord(propertyCommands[i]))
+	}
+	for i := range messageCommands {
+		records = append(records, messageCommandToLogRecord(messageCommands[i]))
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	defer self.reportDrops()
+	self.Lock()
+	defer self.Unlock()
+	segment := self.next
+	path := logSegmentPath(self.dir, segment)
+	// Another Spillover may write to the same directory while Reconfigure replaces
+	// the write communicator, its segments are picked up by the next OpenSpillover.
+	for _, err := os.Stat(path); err == nil; _, err = os.Stat(path) {
+		segment++
+		path = logSegmentPath(self.dir, segment)
+	}
+	self.next = segment + 1
+	size, err := writeLogFile(path, records)
+	if err != nil {
+		return err
+	}
+	spillSegment := &spillSegment{size: size, commands: len(records), created: time.Now()}
+	spillSegment.counts.addCommands(seriesCommandsChunk, entityTagCommands, propertyCommands, messageCommands)
+	self.segments[segment] = spillSegment
+	self.unsafeEnforceBounds()
+	return nil
+}
+
+// writeLogFile writes the records to a temporary file and renames it to path,
+// so that a crash never leaves a partially written segment behind.
+func writeLogFile(path string, records []*logRecord) (int64, error) {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	writer := bufio.NewWriter(file)
+	size, err := writeLogRecords(writer, records)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return size, err
+}
+
+// unsafeEnforceBounds discards expired segments and then the oldest segments
+// until the total size fits. Segments being requeued are left alone.
+func (self *Spillover) unsafeEnforceBounds() {
+	segments := self.unsafeSortedSegments()
+	if self.maxAge > 0 {
+		expiry := time.Now().Add(-self.maxAge)
+		for _, segment := range segments {
+			if !self.segments[segment].inFlight && self.segments[segment].created.Before(expiry) {
+				self.unsafeDiscard(segment)
+			}
+		}
+	}
+	if self.maxSize > 0 {
+		for _, segment := range segments {
+			if self.unsafeSize() <= self.maxSize {
+				break
+			}
+			if spillSegment, ok := self.segments[segment]; ok && !spillSegment.inFlight {
+				self.unsafeDiscard(segment)
+			}
+		}
+	}
+}
+
+func (self *Spillover) unsafeDiscard(segment uint64) {
+	self.dropped += uint64(self.segments[segment].commands)
+	self.unreported.add(&self.segments[segment].counts)
+	self.unsafeRemove(segment)
+}
+
+// reportDrops passes the commands discarded since the last call to the listener.
+func (self *Spillover) reportDrops() {
+	self.Lock()
+	unreported := self.unreported
+	self.unreported = UndeliveredError{}
+	self.Unlock()
+	self.listener.onDrop(&unreported)
+}
+
+// SetListener sets the listener told about the commands discarded because of the bounds.
+func (self *Spillover) SetListener(listener Listener) {
+	self.listener.SetListener(listener)
+}
+
+func (self *Spillover) unsafeRemove(segment uint64) {
+	os.Remove(logSegmentPath(self.dir, segment))
+	delete(self.segments, segment)
+	for _, command := range self.requeued[segment] {
+		delete(self.requeuedCommands, command)
+	}
+	delete(self.requeued, segment)
+}
+
+func (self *Spillover) unsafeSortedSegments() []uint64 {
+	segments := make([]uint64, 0, len(self.segments))
+	for segment := range self.segments {
+		segments = append(segments, segment)
+	}
+	sort.Sort(segmentIds(segments))
+	return segments
+}
+
+type spilledBatch struct {
+	segment           uint64
+	seriesCommands    []*net.SeriesCommand
+	entityTagCommands []*net.EntityTagCommand
+	propertyCommands  []*net.PropertyCommand
+	messageCommands   []*net.MessageCommand
+}
+
+// takeOldest reads the oldest segment that is not already being requeued and
+// marks it as in flight, or returns nil if there is none. The segment stays on
+// disk until remove is called. A read error still returns the commands decoded
+// before it, and the segment file is renamed with the quarantineSuffix then, so
+// that removing the segment does not delete the part that could not be read.
+func (self *Spillover) takeOldest() (*spilledBatch, error) {
+	defer self.reportDrops()
+	self.Lock()
+	defer self.Unlock()
+	self.unsafeEnforceBounds()
+	for _, segment := range self.unsafeSortedSegments() {
+		if self.segments[segment].inFlight {
+			continue
+		}
+		self.segments[segment].inFlight = true
+		batch := &spilledBatch{segment: segment}
+		path := logSegmentPath(self.dir, segment)
+		_, err := readLogFile(path, func(command interface{}) {
+			switch command := command.(type) {
+			case *net.SeriesCommand:
+				batch.seriesCommands = append(batch.seriesCommands, command)
+			case *net.EntityTagCommand:
+				batch.entityTagCommands = append(batch.entityTagCommands, command)
+			case *net.PropertyCommand:
+				batch.propertyCommands = append(batch.propertyCommands, command)
+			case *net.MessageCommand:
+				batch.messageCommands = append(batch.messageCommands, command)
+			}
+		})
+		if err != nil {
+			err = fmt.Errorf("segment %v: %v, the segment is kept as %v", segment, err, path+quarantineSuffix)
+			if renameErr := os.Rename(path, path+quarantineSuffix); renameErr != nil {
+				err = fmt.Errorf("%v, could not rename it: %v", err, renameErr)
+			}
+		}
+		return batch, err
+	}
+	return nil, nil
+}
+
+// quarantineSuffix is appended to the name of a segment file that could not be read completely.
+const quarantineSuffix = ".corrupt"
+
+func (self *Spillover) remove(segment uint64) {
+	self.Lock()
+	defer self.Unlock()
+	self.unsafeRemove(segment)
+}
+
+// markRequeued remembers the commands of the batch until its segment is removed.
+func (self *Spillover) markRequeued(batch *spilledBatch) {
+	self.Lock()
+	defer self.Unlock()
+	commands := []interface{}{}
+	for _, command := range batch.seriesCommands {
+		commands = append(commands, command)
+	}
+	for _, command := range batch.entityTagCommands {
+		commands = append(commands, command)
+	}
+	for _, command := range batch.propertyCommands {
+		commands = append(commands, command)
+	}
+	for _, command := range batch.messageCommands {
+		commands = append(commands, command)
+	}
+	for _, command := range commands {
+		self.requeuedCommands[command] = true
+	}
+	self.requeued[batch.segment] = commands
+}
+
+// isRequeued reports whether the command was read from a segment that is still on
+// disk, so that it is requeued again after a restart if it is not delivered.
+func (self *Spillover) isRequeued(command interface{}) bool {
+	self.Lock()
+	defer self.Unlock()
+	return self.requeuedCommands[command]
+}
+
+// requeue hands spilled batches to the write communicator, oldest first, for as
+// long as it stays connected and stop returns false. A segment is removed from
+// disk once its batch is delivered, and its metadata commands are recorded in
+// metadataCompacter, if not nil.
+func (self *Spillover) requeue(communicator func() transport, stop func() bool, metadataCompacter *MetadataCompacter) {
+	for communicator().IsConnected() && !stop() {
+		batch, err := self.takeOldest()
+		if err != nil {
+			logger.Error("Could not read spilled data: ", err)
+		}
+		if batch == nil {
+			return
+		}
+		segment := batch.segment
+		self.markRequeued(batch)
+		communicator().queuedSendData(
+			seriesCommandsToChunks(batch.seriesCommands),
+			batch.entityTagCommands,
+			batch.propertyCommands,
+			batch.messageCommands,
+			metadataCompacter.onDelivered(batch.entityTagCommands, batch.propertyCommands, func() { self.remove(segment) }),
+		)
+	}
+}
+
+// isEmpty reports whether no segment is left, including the ones being requeued.
+func (self *Spillover) isEmpty() bool {
+	self.Lock()
+	defer self.Unlock()
+	return len(self.segments) == 0
+}
+
+// Size returns the number of bytes held in spilled segments.
+func (self *Spillover) Size() int64 {
+	self.Lock()
+	defer self.Unlock()
+	return self.unsafeSize()
+}
+func (self *Spillover) unsafeSize() int64 {
+	size := int64(0)
+	for _, segment := range self.segments {
+		size += segment.size
+	}
+	return size
+}
+
+// CommandCount returns the number of commands held in spilled segments.
+func (self *Spillover) CommandCount() int {
+	self.Lock()
+	defer self.Unlock()
+	count := 0
+	for _, segment := range self.segments {
+		count += segment.commands
+	}
+	return count
+}
+
+// DroppedCount returns the number of spilled commands discarded because of the size or age bounds.
+func (self *Spillover) DroppedCount() uint64 {
+	self.Lock()
+	defer self.Unlock()
+	return self.dropped
+}
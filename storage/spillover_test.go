@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+// fakeCommunicator records queued batches and acknowledges them immediately.
+type fakeCommunicator struct {
+	connected bool
+	batches   [][]*net.SeriesCommand
+	sync.Mutex
+}
+
+func (self *fakeCommunicator) QueuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, properties []*net.PropertyCommand, messages []*net.MessageCommand) {
+	self.queuedSendData(seriesCommandsChunk, entityTagCommands, properties, messages, nil)
+}
+func (self *fakeCommunicator) queuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, properties []*net.PropertyCommand, messages []*net.MessageCommand, delivered func()) {
+	self.Lock()
+	batch := []*net.SeriesCommand{}
+	for _, chunk := range seriesCommandsChunk {
+		for el := chunk.Front(); el != nil; el = el.Next() {
+			batch = append(batch, el.Value.(*net.SeriesCommand))
+		}
+	}
+	self.batches = append(self.batches, batch)
+	self.Unlock()
+	if delivered != nil {
+		delivered()
+	}
+}
+func (self *fakeCommunicator) PriorSendData(seriesCommands []*net.SeriesCommand, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand) {
+}
+func (self *fakeCommunicator) SendAndWait(ctx context.Context, batch *Batch) error { return nil }
+func (self *fakeCommunicator) SetListener(listener Listener)                       {}
+func (self *fakeCommunicator) SetDeadLetterHandler(handler DeadLetterHandler)      {}
+func (self *fakeCommunicator) SelfMetricValues() []*metricValue                    { return nil }
+func (self *fakeCommunicator) IsConnected() bool {
+	self.Lock()
+	defer self.Unlock()
+	return self.connected
+}
+func (self *fakeCommunicator) Close(ctx context.Context) error { return nil }
+
+func TestSpilloverRequeue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spillover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := GetDefaultConfig()
+	config.SpilloverDir = dir
+	memstore, _ := NewMemStore(minMemoryLimit)
+	communicator := &fakeCommunicator{}
+	storage, err := newStorage(config, memstore, communicator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		storage.QueuedSendSeriesCommands("", seriesCommands("entity001", i+1))
+		storage.ForceSend()
+	}
+	if len(communicator.batches) != 0 || storage.spillover.CommandCount() != 6 {
+		t.Fatal("data was not spilled while disconnected: ", len(communicator.batches), storage.spillover.CommandCount())
+	}
+
+	communicator.connected = true
+	storage.QueuedSendSeriesCommands("", seriesCommands("entity001", 4))
+	storage.ForceSend()
+	if len(communicator.batches) != 4 {
+		t.Fatal("unexpected batch count: ", len(communicator.batches))
+	}
+	for i, batch := range communicator.batches {
+		if len(batch) != i+1 {
+			t.Error("batch ", i, " was requeued out of order: ", len(batch))
+		}
+	}
+	if storage.spillover.Size() != 0 {
+		t.Error("delivered segments were not removed: ", storage.spillover.Size())
+	}
+}
+
+func TestSpilloverBounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spillover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spillover, err := OpenSpillover(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spillover.Spill(seriesCommandsToChunks(seriesCommands("entity001", 10)), nil, nil, nil)
+	size := spillover.Size()
+	spillover.Spill(seriesCommandsToChunks(seriesCommands("entity001", 10)), nil, nil, nil)
+
+	spillover, err = OpenSpillover(dir, ByteSize(size), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &recordingListener{}
+	spillover.SetListener(listener)
+	spillover.Spill(seriesCommandsToChunks(seriesCommands("entity001", 10)), nil, nil, nil)
+	if spillover.Size() != size || spillover.DroppedCount() != 20 {
+		t.Error("size bound was not enforced: size = ", spillover.Size(), " dropped = ", spillover.DroppedCount())
+	}
+	if dropped := listener.dropped(SeriesCommandType); dropped != 20 {
+		t.Error("unexpected drops reported to the listener: ", dropped)
+	}
+
+	spillover, err = OpenSpillover(dir, 0, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch, _ := spillover.takeOldest(); batch != nil || spillover.DroppedCount() != 10 {
+		t.Error("age bound was not enforced: ", spillover.DroppedCount())
+	}
+}
+
+func TestSpilloverQuarantinesUnreadableSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spillover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spillover, err := OpenSpillover(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spillover.Spill(seriesCommandsToChunks(seriesCommands("entity001", 2)), nil, nil, nil)
+	path := logSegmentPath(dir, 0)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("{not json\n")
+	file.Close()
+	stale := logSegmentPath(dir, 1) + ".tmp"
+	ioutil.WriteFile(stale, []byte("{"), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(stale, old, old)
+
+	spillover, err = OpenSpillover(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("the stale temporary file was not removed: ", err)
+	}
+	batch, err := spillover.takeOldest()
+	if err == nil || batch == nil || len(batch.seriesCommands) != 2 {
+		t.Fatal("expected the readable commands and an error, got ", batch, err)
+	}
+	spillover.remove(batch.segment)
+	if _, err := os.Stat(path + quarantineSuffix); err != nil {
+		t.Error("the unreadable segment was not kept: ", err)
+	}
+}
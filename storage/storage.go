@@ -17,7 +17,10 @@ package storage
 
 import (
 	"container/list"
+	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/axibase/atsd-api-go/net"
@@ -37,18 +40,148 @@ func NewChunk() *Chunk {
 	return &Chunk{list.New()}
 }
 
+// deliveryAck counts the parts of one queuedSendData call that are still queued
+// or being sent, and runs delivered once the last of them is written out.
+type deliveryAck struct {
+	pending   int64
+	delivered func()
+}
+
+func newDeliveryAck(parts int, delivered func()) *deliveryAck {
+	ack := &deliveryAck{pending: int64(parts), delivered: delivered}
+	if parts == 0 && delivered != nil {
+		delivered()
+	}
+	return ack
+}
+func (self *deliveryAck) done() {
+	if atomic.AddInt64(&self.pending, -1) == 0 && self.delivered != nil {
+		self.delivered()
+	}
+}
+
+type queuedSeriesChunk struct {
+	chunk *Chunk
+	ack   *deliveryAck
+}
+type queuedEntityTagCommands struct {
+	commands []*net.EntityTagCommand
+	ack      *deliveryAck
+}
+type queuedPropertyCommands struct {
+	commands []*net.PropertyCommand
+	ack      *deliveryAck
+}
+type queuedMessageCommands struct {
+	commands []*net.MessageCommand
+	ack      *deliveryAck
+}
+
 type IWriteCommunicator interface {
 	QueuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, properties []*net.PropertyCommand, messages []*net.MessageCommand)
 	PriorSendData(seriesCommands []*net.SeriesCommand, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand)
 	SelfMetricValues() []*metricValue
 }
+
+// transport is the write communicator Storage sends through. The communicators of
+// this package implement it besides IWriteCommunicator, which keeps its original
+// methods, and NewFanOutCommunicator checks for it with a type assertion.
+type transport interface {
+	IWriteCommunicator
+	// queuedSendData is QueuedSendData calling delivered, if not nil, once all
+	// of the commands have been written to the destination.
+	queuedSendData(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, properties []*net.PropertyCommand, messages []*net.MessageCommand, delivered func())
+	// SendAndWait sends the batch right away, bypassing the queues, and returns a
+	// BatchError listing the command types that could not be sent.
+	SendAndWait(ctx context.Context, batch *Batch) error
+	// IsConnected reports false while the destination is known to be unreachable.
+	IsConnected() bool
+	// Close flushes queued data and stops the sender goroutines, see Storage.Close.
+	Close(ctx context.Context) error
+	SetListener(listener Listener)
+	// SetDeadLetterHandler sets the handler of the commands that ATSD rejected as invalid.
+	SetDeadLetterHandler(handler DeadLetterHandler)
+}
+
+// UndeliveredError lists the commands that were dropped because Close hit its deadline.
+type UndeliveredError struct {
+	SeriesCommands    uint64
+	PropertyCommands  uint64
+	MessageCommands   uint64
+	EntityTagCommands uint64
+}
+
+func (self *UndeliveredError) Error() string {
+	return fmt.Sprintf("could not deliver %v series, %v property, %v message and %v entity-tag commands before the deadline",
+		atomic.LoadUint64(&self.SeriesCommands),
+		atomic.LoadUint64(&self.PropertyCommands),
+		atomic.LoadUint64(&self.MessageCommands),
+		atomic.LoadUint64(&self.EntityTagCommands))
+}
+func (self *UndeliveredError) add(other *UndeliveredError) {
+	atomic.AddUint64(&self.SeriesCommands, atomic.LoadUint64(&other.SeriesCommands))
+	atomic.AddUint64(&self.PropertyCommands, atomic.LoadUint64(&other.PropertyCommands))
+	atomic.AddUint64(&self.MessageCommands, atomic.LoadUint64(&other.MessageCommands))
+	atomic.AddUint64(&self.EntityTagCommands, atomic.LoadUint64(&other.EntityTagCommands))
+}
+func (self *UndeliveredError) addCommands(seriesCommandsChunk []*Chunk, entityTagCommands []*net.EntityTagCommand, propertyCommands []*net.PropertyCommand, messageCommands []*net.MessageCommand) {
+	for _, chunk := range seriesCommandsChunk {
+		atomic.AddUint64(&self.SeriesCommands, uint64(chunk.Len()))
+	}
+	atomic.AddUint64(&self.PropertyCommands, uint64(len(propertyCommands)))
+	atomic.AddUint64(&self.MessageCommands, uint64(len(messageCommands)))
+	atomic.AddUint64(&self.EntityTagCommands, uint64(len(entityTagCommands)))
+}
+func (self *UndeliveredError) isEmpty() bool {
+	return atomic.LoadUint64(&self.SeriesCommands) == 0 &&
+		atomic.LoadUint64(&self.PropertyCommands) == 0 &&
+		atomic.LoadUint64(&self.MessageCommands) == 0 &&
+		atomic.LoadUint64(&self.EntityTagCommands) == 0
+}
+func (self *UndeliveredError) errorOrNil() error {
+	if self.isEmpty() {
+		return nil
+	}
+	undelivered := &UndeliveredError{}
+	undelivered.add(self)
+	return undelivered
+}
+
 type Storage struct {
+	config            Config
 	selfMetricsEntity string
 	metricPrefix      string
 
 	memstore          *MemStore
+	spillover         *Spillover
 	dataCompacter     *DataCompacter
-	writeCommunicator IWriteCommunicator
+	metadataCompacter *MetadataCompacter
+
+	// journal filters the dead letters Storage and its communicator report.
+	journal journal
+
+	// writeCommunicator and deadLetters are replaced by Reconfigure, which holds
+	// transportMutex for writing. Everything else reads the communicator through
+	// communicator(), so nothing holds the lock while it blocks on ATSD.
+	// deadLetters is the sink Storage owns and closes, if any.
+	writeCommunicator transport
+	deadLetters       DeadLetterSink
+	// deadLetterSinkSet is set by SetDeadLetterSink, its sink replaces the dead-letter
+	// settings of config until Reconfigure changes them.
+	deadLetterSinkSet bool
+	newTransport      func(config Config) (transport, error)
+	transportMutex    sync.RWMutex
+
+	// handOffQueue passes released batches to deliveryTask, which runs until
+	// stopDelivery is closed and then closes deliveryDone. Once abandon is closed
+	// it no longer waits for the communicator and counts what it drops in abandoned.
+	handOffQueue chan *releasedBatch
+	stopDelivery chan struct{}
+	deliveryDone chan struct{}
+	abandon      chan struct{}
+	abandoned    UndeliveredError
+	// listeners reports the commands Storage drops itself.
+	listeners listenerHolder
 
 	isUpdating             bool
 	updateInterval         time.Duration
@@ -58,18 +191,179 @@ type Storage struct {
 	mutex                  sync.Mutex
 }
 
+// releasedBatch is one release of the memstore on its way to the write communicator.
+// queued is closed once the batch is queued or spilled.
+type releasedBatch struct {
+	seriesCommandsChunk []*Chunk
+	entityTagCommands   []*net.EntityTagCommand
+	propertyCommands    []*net.PropertyCommand
+	messageCommands     []*net.MessageCommand
+	delivered           func()
+	queued              chan struct{}
+}
+
 func (self *Storage) updateTask() {
-	seriesCommandsChunks := self.memstore.ReleaseSeriesCommandChunks()
-	properties := self.memstore.ReleaseProperties()
-	entityTagCommands := self.memstore.ReleaseEntityTagCommands()
-	messageCommands := self.memstore.ReleaseMessageCommands()
+	self.handOff(false)
+}
+
+// handOff releases the memstore and passes the data to the delivery goroutine. With
+// a spillover the data is spilled instead if the write communicator is disconnected,
+// or if the delivery goroutine is still stuck on an earlier batch because ATSD went
+// down since. Otherwise handOff waits for the delivery goroutine, and with wait set
+// also until the data is queued.
+func (self *Storage) handOff(wait bool) {
+	if held := self.dataCompacter.Flush(); len(held) > 0 {
+		self.memstore.AppendSeriesCommands(held)
+	}
+	seriesCommandsChunks, entityTagCommands, properties, messageCommands, delivered := self.memstore.ReleaseAll()
+	batch := &releasedBatch{
+		seriesCommandsChunk: seriesCommandsChunks,
+		entityTagCommands:   entityTagCommands,
+		propertyCommands:    properties,
+		messageCommands:     messageCommands,
+		delivered:           delivered,
+		queued:              make(chan struct{}),
+	}
+
+	if self.spillover != nil {
+		if !self.communicator().IsConnected() && self.spillInOrder(batch) {
+			return
+		}
+		if !wait {
+			select {
+			case self.handOffQueue <- batch:
+				return
+			default:
+			}
+			if self.spillInOrder(batch) {
+				return
+			}
+		}
+	}
+
+	self.enqueue(batch)
+	if wait {
+		<-batch.queued
+	}
+}
+
+// enqueue waits until the delivery goroutine takes the batch, or delivers it
+// itself once the goroutine has finished.
+func (self *Storage) enqueue(batch *releasedBatch) {
+	select {
+	case self.handOffQueue <- batch:
+	case <-self.deliveryDone:
+		self.deliver(batch)
+	}
+}
+
+// spillInOrder spills the batch waiting in the hand-off queue, if any, before the
+// given one. The delivery goroutine requeues spilled data before the next handed
+// off batch, so nothing spilled may be newer than a batch still waiting.
+func (self *Storage) spillInOrder(batch *releasedBatch) bool {
+	select {
+	case waiting := <-self.handOffQueue:
+		if !self.spill(waiting) {
+			self.enqueue(waiting)
+			return false
+		}
+	default:
+	}
+	return self.spill(batch)
+}
+
+func (self *Storage) spill(batch *releasedBatch) bool {
+	err := self.spillover.Spill(batch.seriesCommandsChunk, batch.entityTagCommands, batch.propertyCommands, batch.messageCommands)
+	if err != nil {
+		logger.Error("Could not spill released data, queueing it instead: ", err)
+		return false
+	}
+	if batch.delivered != nil {
+		batch.delivered()
+	}
+	close(batch.queued)
+	return true
+}
+
+// deliveryTask queues the handed off batches and the spilled ones on the write
+// communicator, the only place where Storage blocks on an unreachable ATSD.
+// It drains the hand-off queue and returns once stopDelivery is closed.
+func (self *Storage) deliveryTask(requeueInterval time.Duration) {
+	defer close(self.deliveryDone)
+	var requeue <-chan time.Time
+	if self.spillover != nil {
+		ticker := time.NewTicker(requeueInterval)
+		defer ticker.Stop()
+		requeue = ticker.C
+	}
+	for {
+		select {
+		case batch := <-self.handOffQueue:
+			self.deliver(batch)
+		case <-requeue:
+			self.requeueSpilled()
+		case <-self.stopDelivery:
+			for {
+				select {
+				case batch := <-self.handOffQueue:
+					self.deliver(batch)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
 
-	self.writeCommunicator.QueuedSendData(seriesCommandsChunks, entityTagCommands, properties, messageCommands)
+// deliver queues the batch after the spilled data, which is older. Once Close has
+// given up waiting the batch is spilled if possible, otherwise it is dropped and
+// counted in abandoned.
+func (self *Storage) deliver(batch *releasedBatch) {
+	if self.isAbandoning() {
+		if self.spillover == nil || !self.spill(batch) {
+			self.listeners.dropCommands(&self.abandoned, errCloseDeadline, batch.seriesCommandsChunk, batch.entityTagCommands, batch.propertyCommands, batch.messageCommands)
+			close(batch.queued)
+		}
+		return
+	}
+	if self.spillover != nil {
+		self.requeueSpilled()
+	}
+	delivered := self.metadataCompacter.onDelivered(batch.entityTagCommands, batch.propertyCommands, batch.delivered)
+	self.communicator().queuedSendData(batch.seriesCommandsChunk, batch.entityTagCommands, batch.propertyCommands, batch.messageCommands, delivered)
+	close(batch.queued)
+}
 
+func (self *Storage) isAbandoning() bool {
+	select {
+	case <-self.abandon:
+		return true
+	default:
+		return false
+	}
+}
+
+// requeueSpilled hands spilled batches to the write communicator, oldest first,
+// for as long as it stays connected.
+func (self *Storage) requeueSpilled() {
+	self.spillover.requeue(self.communicator, self.isAbandoning, self.metadataCompacter)
 }
+
+// communicator returns the current write communicator. The caller must not hold
+// transportMutex while it blocks on the communicator, or Reconfigure would wait for it.
+func (self *Storage) communicator() transport {
+	self.transportMutex.RLock()
+	defer self.transportMutex.RUnlock()
+	return self.writeCommunicator
+}
+
 func (self *Storage) selfMetricSendTask() {
+	writeCommunicator := self.communicator()
+	self.dataCompacter.Evict()
 	timestamp := net.Millis(time.Now().UnixNano() / 1e6)
-	writeCommunicatorMetricValues := self.writeCommunicator.SelfMetricValues()
+	writeCommunicatorMetricValues := append(writeCommunicator.SelfMetricValues(), self.memstore.SelfMetricValues()...)
+	writeCommunicatorMetricValues = append(writeCommunicatorMetricValues, self.dataCompacter.SelfMetricValues()...)
+	writeCommunicatorMetricValues = append(writeCommunicatorMetricValues, self.metadataCompacter.SelfMetricValues()...)
 
 	seriesCommands := []*net.SeriesCommand{}
 	for _, metricValue := range writeCommunicatorMetricValues {
@@ -91,22 +385,113 @@ func (self *Storage) selfMetricSendTask() {
 	seriesCommands = append(seriesCommands, seriesCommand)
 	seriesCommand = net.NewSeriesCommand(self.selfMetricsEntity, self.metricPrefix+".memstore.size", net.Int64(self.memstore.Size())).SetTimestamp(timestamp)
 	seriesCommands = append(seriesCommands, seriesCommand)
-	self.writeCommunicator.PriorSendData(seriesCommands, nil, nil, nil)
+	seriesCommand = net.NewSeriesCommand(self.selfMetricsEntity, self.metricPrefix+".memstore.bytes", net.Int64(self.memstore.Bytes())).SetTimestamp(timestamp)
+	seriesCommands = append(seriesCommands, seriesCommand)
+	if self.spillover != nil {
+		seriesCommand = net.NewSeriesCommand(self.selfMetricsEntity, self.metricPrefix+".spillover.size", net.Int64(self.spillover.Size())).SetTimestamp(timestamp)
+		seriesCommands = append(seriesCommands, seriesCommand)
+		seriesCommand = net.NewSeriesCommand(self.selfMetricsEntity, self.metricPrefix+".spillover.commands.count", net.Int64(self.spillover.CommandCount())).SetTimestamp(timestamp)
+		seriesCommands = append(seriesCommands, seriesCommand)
+		seriesCommand = net.NewSeriesCommand(self.selfMetricsEntity, self.metricPrefix+".spillover.commands.dropped", net.Int64(self.spillover.DroppedCount())).SetTimestamp(timestamp)
+		seriesCommands = append(seriesCommands, seriesCommand)
+	}
+	if wal := self.memstore.WriteAheadLog(); wal != nil {
+		seriesCommand = net.NewSeriesCommand(self.selfMetricsEntity, self.metricPrefix+".memstore.log.size", net.Int64(wal.Size())).SetTimestamp(timestamp)
+		seriesCommands = append(seriesCommands, seriesCommand)
+		seriesCommand = net.NewSeriesCommand(self.selfMetricsEntity, self.metricPrefix+".memstore.log.replayed", net.Int64(wal.ReplayedCount())).SetTimestamp(timestamp)
+		seriesCommands = append(seriesCommands, seriesCommand)
+	}
+	writeCommunicator.PriorSendData(seriesCommands, nil, nil, nil)
 
 }
 
-func (self *Storage) QueuedSendSeriesCommands(group string, seriesCommands []*net.SeriesCommand) {
+// QueuedSendSeriesCommands filters the commands through the group deduplication
+// params, or Config.DeduplicationRules when the group is not configured, and
+// queues the rest. It returns how many commands the memstore accepted
+// and ErrMemstoreFull if the overflow policy rejected some of them.
+func (self *Storage) QueuedSendSeriesCommands(group string, seriesCommands []*net.SeriesCommand) (int, error) {
 	filteredSeriesCommands := self.dataCompacter.Filter(group, seriesCommands)
-	self.memstore.AppendSeriesCommands(filteredSeriesCommands)
+	return self.memstore.AppendSeriesCommands(filteredSeriesCommands)
 }
-func (self *Storage) QueuedSendPropertyCommands(propertyCommands []*net.PropertyCommand) {
-	self.memstore.AppendPropertyCommands(propertyCommands)
+
+// QueuedSendPropertyCommands drops the commands that repeat the last delivered content
+// of their property within Config.MetadataRefreshInterval and queues the rest.
+func (self *Storage) QueuedSendPropertyCommands(propertyCommands []*net.PropertyCommand) (int, error) {
+	return self.memstore.AppendPropertyCommands(self.metadataCompacter.FilterProperties(propertyCommands))
 }
-func (self *Storage) QueuedSendEntityTagCommands(entityTagCommands []*net.EntityTagCommand) {
-	self.memstore.AppendEntityTagCommands(entityTagCommands)
+
+// QueuedSendEntityTagCommands drops the commands that repeat the last delivered tags
+// of their entity within Config.MetadataRefreshInterval and queues the rest.
+func (self *Storage) QueuedSendEntityTagCommands(entityTagCommands []*net.EntityTagCommand) (int, error) {
+	return self.memstore.AppendEntityTagCommands(self.metadataCompacter.FilterEntityTags(entityTagCommands))
 }
-func (self *Storage) QueuedSendMessageCommands(messageCommands []*net.MessageCommand) {
-	self.memstore.AppendMessageCommands(messageCommands)
+func (self *Storage) QueuedSendMessageCommands(messageCommands []*net.MessageCommand) (int, error) {
+	return self.memstore.AppendMessageCommands(messageCommands)
+}
+
+// ReinjectDeadLetters queues the commands of a file written by FileDeadLetterSink
+// again, bypassing deduplication. The file should no longer be written to, e.g.
+// it is the dead-letter file of a previous run. It returns how many commands the
+// memstore accepted.
+func (self *Storage) ReinjectDeadLetters(path string) (int, error) {
+	batch, err := ReadDeadLetters(path)
+	if err != nil {
+		return 0, err
+	}
+	accepted := 0
+	for _, appendCommands := range []func() (int, error){
+		func() (int, error) { return self.memstore.AppendEntityTagCommands(batch.EntityTagCommands) },
+		func() (int, error) { return self.memstore.AppendPropertyCommands(batch.PropertyCommands) },
+		func() (int, error) { return self.memstore.AppendSeriesCommands(batch.SeriesCommands) },
+		func() (int, error) { return self.memstore.AppendMessageCommands(batch.MessageCommands) },
+	} {
+		count, err := appendCommands()
+		accepted += count
+		if err != nil {
+			return accepted, err
+		}
+	}
+	return accepted, nil
+}
+
+// SendAndWait sends the batch without deduplication or queueing and waits for
+// the result. A non-nil error is a BatchError with a *SendError for every
+// command type that failed, carrying the ATSD response status for HTTP transports.
+func (self *Storage) SendAndWait(ctx context.Context, batch *Batch) error {
+	return self.communicator().SendAndWait(ctx, batch)
+}
+
+// SetDeadLetterSink makes sink receive the dead letters instead of the configured
+// DeadLetterHandler or DeadLetterFile; a nil sink logs them. Storage takes ownership
+// of sink and closes it in Close. The sink it replaces is closed right away. The sink
+// stays across Reconfigure calls that do not change DeadLetterHandler or DeadLetterFile.
+func (self *Storage) SetDeadLetterSink(sink DeadLetterSink) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.transportMutex.Lock()
+	oldDeadLetters := self.deadLetters
+	self.deadLetters = sink
+	writeCommunicator := self.writeCommunicator
+	self.transportMutex.Unlock()
+
+	self.deadLetterSinkSet = true
+	config := self.withDeadLetterSink(self.config)
+	writeCommunicator.SetDeadLetterHandler(self.journal.filter(config.DeadLetterHandler))
+	self.setListeners(config, sink)
+	if oldDeadLetters != nil && !isSameHandler(oldDeadLetters, sink) {
+		return oldDeadLetters.Close()
+	}
+	return nil
+}
+
+// withDeadLetterSink returns config with the dead-letter settings replaced by the
+// sink set by SetDeadLetterSink, if any.
+func (self *Storage) withDeadLetterSink(config Config) Config {
+	if self.deadLetterSinkSet {
+		config.DeadLetterHandler = self.deadLetters
+		config.DeadLetterFile = ""
+	}
+	return config
 }
 
 func (self *Storage) StartPeriodicSending() {
@@ -118,24 +503,85 @@ func (self *Storage) StartPeriodicSending() {
 		self.isUpdating = true
 	}
 }
+
+// StopPeriodicSending stops the periodic tasks without waiting for them: a task
+// that is blocked on an unreachable ATSD finishes when the transport gives up.
 func (self *Storage) StopPeriodicSending() {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
 	if self.isUpdating {
-		self.stopSelfMetricSendTask <- true
-		self.stopUpdateTask <- true
+		close(self.stopSelfMetricSendTask)
+		close(self.stopUpdateTask)
 		self.isUpdating = false
 	}
 }
+
+// ForceSend releases the memstore right away and waits until the data is queued for sending.
 func (self *Storage) ForceSend() {
-	self.updateTask()
+	self.handOff(true)
+}
+
+// Close stops periodic sending, hands everything left in the memstore to the
+// write communicator and waits until it is delivered or ctx is done. The error
+// is an *UndeliveredError if some commands could not be delivered in time.
+// Storage must not be used after Close.
+func (self *Storage) Close(ctx context.Context) error {
+	self.StopPeriodicSending()
+
+	if held := self.dataCompacter.flush(true); len(held) > 0 {
+		self.memstore.AppendSeriesCommands(held)
+	}
+	finalUpdate := make(chan struct{})
+	go func() {
+		self.handOff(true)
+		close(self.stopDelivery)
+		<-self.deliveryDone
+		close(finalUpdate)
+	}()
+	select {
+	case <-finalUpdate:
+	case <-ctx.Done():
+		close(self.abandon)
+	}
+
+	err := self.communicator().Close(ctx)
+	<-finalUpdate
+	if !self.abandoned.isEmpty() {
+		if undelivered, ok := err.(*UndeliveredError); ok {
+			undelivered.add(&self.abandoned)
+		} else if err == nil {
+			err = self.abandoned.errorOrNil()
+		}
+	}
+	self.transportMutex.RLock()
+	deadLetters := self.deadLetters
+	self.transportMutex.RUnlock()
+	if deadLetters != nil {
+		if deadLettersErr := deadLetters.Close(); deadLettersErr != nil && err == nil {
+			err = deadLettersErr
+		}
+	}
+	if wal := self.memstore.WriteAheadLog(); wal != nil {
+		if walErr := wal.Close(); walErr != nil && err == nil {
+			err = walErr
+		}
+	}
+	return err
 }
 
 func schedule(task func(), updateInterval time.Duration) chan bool {
+	return scheduleEvery(task, updateInterval, true)
+}
+
+// scheduleEvery runs task every updateInterval, and right away if runNow is set,
+// until the returned channel is closed.
+func scheduleEvery(task func(), updateInterval time.Duration, runNow bool) chan bool {
 	stop := make(chan bool)
 	go func() {
 		ticker := time.NewTicker(updateInterval)
-		task()
+		if runNow {
+			task()
+		}
 		for {
 			select {
 			case <-ticker.C:
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	atsdNet "github.com/axibase/atsd-api-go/net"
+)
+
+func listenCommands(t *testing.T) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return listener, lines
+}
+
+func TestStorageClose(t *testing.T) {
+	listener, lines := listenCommands(t)
+	defer listener.Close()
+
+	config := GetDefaultConfig()
+	config.Url = &url.URL{Scheme: "tcp", Host: listener.Addr().String()}
+	storage, err := NewFactoryFromConfig(config).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.QueuedSendSeriesCommands("", []*atsdNet.SeriesCommand{
+		atsdNet.NewSeriesCommand("entity001", "metric001", atsdNet.Int64(1)).SetTimestamp(atsdNet.Millis(1000)),
+	})
+	storage.QueuedSendMessageCommands([]*atsdNet.MessageCommand{atsdNet.NewMessageCommand("entity001", "message001")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-lines:
+		case <-time.After(time.Second):
+			t.Fatal("command ", i, " was not delivered before Close returned")
+		}
+	}
+}
+
+func TestStorageCloseDeadline(t *testing.T) {
+	listener, _ := listenCommands(t)
+	address := listener.Addr().String()
+	listener.Close()
+
+	config := GetDefaultConfig()
+	config.Url = &url.URL{Scheme: "tcp", Host: address}
+	storage, err := NewFactoryFromConfig(config).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.QueuedSendMessageCommands([]*atsdNet.MessageCommand{atsdNet.NewMessageCommand("entity001", "message001")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err = storage.Close(ctx)
+	if undelivered, ok := err.(*UndeliveredError); !ok || undelivered.MessageCommands != 1 {
+		t.Error("unexpected error: ", err)
+	}
+}
+
+func TestStorageCloseWhileSendingBlocks(t *testing.T) {
+	listener, _ := listenCommands(t)
+	address := listener.Addr().String()
+	listener.Close()
+
+	config := GetDefaultConfig()
+	config.Url = &url.URL{Scheme: "tcp", Host: address}
+	config.UpdateInterval = 50 * time.Millisecond
+	storage, err := NewFactoryFromConfig(config).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.StartPeriodicSending()
+	for i := 0; i < 3; i++ {
+		storage.QueuedSendMessageCommands([]*atsdNet.MessageCommand{atsdNet.NewMessageCommand("entity001", "message001")})
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	closed := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		closed <- storage.Close(ctx)
+	}()
+	select {
+	case err := <-closed:
+		if _, ok := err.(*UndeliveredError); !ok {
+			t.Error("unexpected error: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return after its deadline")
+	}
+}
+
+// commandServer receives commands like listenCommands, but can also be shut down
+// together with the connections it accepted.
+type commandServer struct {
+	listener net.Listener
+	conns    []net.Conn
+	lines    chan string
+	sync.Mutex
+}
+
+func startCommandServer(t *testing.T, address string, lines chan string) *commandServer {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &commandServer{listener: listener, lines: lines}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.Lock()
+			server.conns = append(server.conns, conn)
+			server.Unlock()
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return server
+}
+
+func (self *commandServer) shutdown() {
+	self.listener.Close()
+	self.Lock()
+	defer self.Unlock()
+	for _, conn := range self.conns {
+		conn.Close()
+	}
+}
+
+func TestStorageSpillsWhenListenerGoesDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spillover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lines := make(chan string, 1000)
+	server := startCommandServer(t, "127.0.0.1:0", lines)
+	address := server.listener.Addr().String()
+
+	config := GetDefaultConfig()
+	config.Url = &url.URL{Scheme: "tcp", Host: address}
+	config.SpilloverDir = dir
+	config.UpdateInterval = 100 * time.Millisecond
+	storage, err := NewFactoryFromConfig(config).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close(context.Background())
+
+	message := []*atsdNet.MessageCommand{atsdNet.NewMessageCommand("entity001", "message001")}
+	storage.QueuedSendMessageCommands(message)
+	storage.updateTask()
+	select {
+	case <-lines:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first cycle was not delivered")
+	}
+
+	server.shutdown()
+	// The first writes after the shutdown may still succeed, keep sending until
+	// the senders get stuck and the data goes to the spillover.
+	sent := 0
+	for storage.spillover.CommandCount() == 0 {
+		if sent == 50 {
+			t.Fatal("nothing was spilled after the listener went down")
+		}
+		storage.QueuedSendMessageCommands(message)
+		started := time.Now()
+		storage.updateTask()
+		if elapsed := time.Since(started); elapsed > time.Second {
+			t.Fatal("update task blocked for ", elapsed)
+		}
+		sent++
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	server = startCommandServer(t, address, lines)
+	defer server.shutdown()
+	deadline := time.After(10 * time.Second)
+	for storage.spillover.CommandCount() > 0 {
+		select {
+		case <-lines:
+		case <-deadline:
+			t.Fatal("spilled data was not delivered after the listener came back: ", storage.spillover.CommandCount())
+		}
+	}
+}
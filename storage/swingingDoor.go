@@ -0,0 +1,117 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"math"
+	"time"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+// SwingingDoor is a threshold that compresses series with the swinging-door
+// trending algorithm: a value is sent only when the series can no longer be
+// reconstructed by linear interpolation between sent values within the given
+// absolute deviation. Unlike Percent and Absolute it keeps ramps and slopes.
+// The value before a change of trend is held back until the change arrives,
+// so it is sent with its original timestamp after a delay. Interval still
+// forces a value to be sent. A held value is also sent when its key is evicted
+// or has not been seen for an update interval, see DataCompacter.Flush.
+type SwingingDoor float64
+
+// swingingDoorState follows the points received after the last archived one.
+// candidate is the latest of them, lower and upper bound the slopes from the
+// archived point that stay within the deviation of all of them.
+type swingingDoorState struct {
+	candidate    *sample
+	origin       seriesOrigin
+	lower, upper float64
+}
+
+// seriesOrigin is the command and metric a held candidate came from, the command
+// sending the candidate is built from them.
+type seriesOrigin struct {
+	command *net.SeriesCommand
+	metric  string
+}
+
+// release archives the held candidate of the entry and returns the command
+// sending it, or nil if nothing is held.
+func (self *compacterEntry) release() *net.SeriesCommand {
+	if self.door.candidate == nil {
+		return nil
+	}
+	held := *self.door.candidate
+	origin := self.door.origin
+	self.sample = held
+	self.door = swingingDoorState{}
+	return withMetric(nil, origin.command, origin.metric, held)
+}
+
+// swingingDoor filters the point of the key like compacterGroup.filter.
+func (self *compacterGroup) swingingDoor(key string, origin seriesOrigin, point sample, deviation float64, interval time.Duration, now time.Time) (*sample, bool) {
+	archive, ok := self.get(key, now)
+	if !ok {
+		self.set(key, point, now)
+		return nil, true
+	}
+	entry := self.entries[key].Value.(*compacterEntry)
+	door := &entry.door
+	last := archive.Time
+	if door.candidate != nil {
+		last = door.candidate.Time
+	}
+	if point.Time <= last {
+		// Out of order points are sent as they are.
+		return nil, true
+	}
+	if interval > 0 && time.Duration(point.Time-archive.Time)*time.Millisecond >= interval {
+		held := door.candidate
+		entry.sample = point
+		*door = swingingDoorState{}
+		return held, true
+	}
+
+	slope := slopeBetween(archive, point.Time, point.Value.Float64())
+	if door.candidate == nil || (door.lower <= slope && slope <= door.upper) {
+		if door.candidate == nil {
+			door.lower, door.upper = math.Inf(-1), math.Inf(1)
+		}
+		door.lower = math.Max(door.lower, slopeBetween(archive, point.Time, point.Value.Float64()-deviation))
+		door.upper = math.Min(door.upper, slopeBetween(archive, point.Time, point.Value.Float64()+deviation))
+		candidate := point
+		door.candidate = &candidate
+		door.origin = origin
+		return nil, false
+	}
+
+	// The line to the point would leave the deviation of an earlier point, so
+	// the candidate is archived and the door starts again from it.
+	held := *door.candidate
+	entry.sample = held
+	candidate := point
+	*door = swingingDoorState{
+		candidate: &candidate,
+		origin:    origin,
+		lower:     slopeBetween(held, point.Time, point.Value.Float64()-deviation),
+		upper:     slopeBetween(held, point.Time, point.Value.Float64()+deviation),
+	}
+	return &held, false
+}
+
+func slopeBetween(from sample, at net.Millis, value float64) float64 {
+	return (value - from.Value.Float64()) / float64(at-from.Time)
+}
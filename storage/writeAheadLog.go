@@ -0,0 +1,547 @@
+/*
+* Copyright 2015 Axibase Corporation or its affiliates. All Rights Reserved.
+*
+* Licensed under the Apache License, Version 2.0 (the "License").
+* You may not use this file except in compliance with the License.
+* A copy of the License is located at
+*
+* https://www.axibase.com/atsd/axibase-apache-2.0.pdf
+*
+* or in the "license" file accompanying this file. This file is distributed
+* on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+* express or implied. See the License for the specific language governing
+* permissions and limitations under the License.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+const (
+	logSegmentPrefix = "segment-"
+	logSegmentSuffix = ".log"
+	maxLogRecordSize = 16 * 1024 * 1024
+)
+
+type logNumber struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// logRecord is the on-disk representation of a single command, one JSON object per line.
+type logRecord struct {
+	Command   string               `json:"command"`
+	Entity    string               `json:"entity"`
+	Metrics   map[string]logNumber `json:"metrics,omitempty"`
+	PropType  string               `json:"propType,omitempty"`
+	Key       map[string]string    `json:"key,omitempty"`
+	Tags      map[string]string    `json:"tags,omitempty"`
+	Message   string               `json:"message,omitempty"`
+	Timestamp *net.Millis          `json:"timestamp,omitempty"`
+	// Evicted marks a tombstone: the command was evicted from the memstore, and
+	// its first record earlier in the segment is not replayed.
+	Evicted bool `json:"evicted,omitempty"`
+}
+
+// WriteAheadLog keeps a copy of every command accepted by a MemStore in segment files.
+// A segment is sealed each time the MemStore is released and removed once
+// the released commands are delivered, so the segments left on disk after
+// a crash hold exactly the commands that may not have reached ATSD. Commands the
+// memstore evicts are followed by a tombstone record and are not replayed.
+type WriteAheadLog struct {
+	dir string
+
+	active uint64
+	file   *os.File
+	writer *bufio.Writer
+
+	sizes    map[uint64]int64
+	replayed uint64
+
+	sync.Mutex
+}
+
+func OpenWriteAheadLog(dir string) (*WriteAheadLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segments, err := listLogSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	wal := &WriteAheadLog{dir: dir, sizes: map[uint64]int64{}}
+	for _, segment := range segments {
+		info, err := os.Stat(wal.segmentPath(segment))
+		if err != nil {
+			return nil, err
+		}
+		wal.active = segment
+		if info.Size() == 0 {
+			os.Remove(wal.segmentPath(segment))
+			continue
+		}
+		wal.sizes[segment] = info.Size()
+	}
+	wal.active++
+	if err := wal.openActiveSegment(); err != nil {
+		return nil, err
+	}
+	return wal, nil
+}
+
+func listLogSegments(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := []uint64{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, logSegmentPrefix) || !strings.HasSuffix(name, logSegmentSuffix) {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, logSegmentPrefix), logSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Sort(segmentIds(segments))
+	return segments, nil
+}
+
+type segmentIds []uint64
+
+func (self segmentIds) Len() int           { return len(self) }
+func (self segmentIds) Less(i, j int) bool { return self[i] < self[j] }
+func (self segmentIds) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func (self *WriteAheadLog) segmentPath(segment uint64) string {
+	return logSegmentPath(self.dir, segment)
+}
+
+func logSegmentPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", logSegmentPrefix, segment, logSegmentSuffix))
+}
+
+func (self *WriteAheadLog) openActiveSegment() error {
+	file, err := os.OpenFile(self.segmentPath(self.active), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	self.file = file
+	self.writer = bufio.NewWriter(file)
+	self.sizes[self.active] = 0
+	return nil
+}
+
+func (self *WriteAheadLog) AppendSeriesCommands(commands []*net.SeriesCommand) error {
+	records := make([]*logRecord, 0, len(commands))
+	for i := range commands {
+		records = append(records, seriesCommandToLogRecord(commands[i]))
+	}
+	return self.append(records)
+}
+func (self *WriteAheadLog) AppendPropertyCommands(commands []*net.PropertyCommand) error {
+	records := make([]*logRecord, 0, len(commands))
+	for i := range commands {
+		records = append(records, propertyCommandToLogRecord(commands[i]))
+	}
+	return self.append(records)
+}
+func (self *WriteAheadLog) AppendEntityTagCommands(commands []*net.EntityTagCommand) error {
+	records := make([]*logRecord, 0, len(commands))
+	for i := range commands {
+		records = append(records, entityTagCommandToLogRecord(commands[i]))
+	}
+	return self.append(records)
+}
+func (self *WriteAheadLog) AppendMessageCommands(commands []*net.MessageCommand) error {
+	records := make([]*logRecord, 0, len(commands))
+	for i := range commands {
+		records = append(records, messageCommandToLogRecord(commands[i]))
+	}
+	return self.append(records)
+}
+
+// appendEvicted writes tombstones for the commands the memstore evicted, so that
+// they are not replayed after a restart.
+func (self *WriteAheadLog) appendEvicted(commands []interface{}) error {
+	records := make([]*logRecord, 0, len(commands))
+	for _, command := range commands {
+		record := commandToLogRecord(command)
+		record.Evicted = true
+		records = append(records, record)
+	}
+	return self.append(records)
+}
+
+// append writes the records to the active segment and flushes them to the OS,
+// which is enough for them to survive a crash of the process itself.
+func (self *WriteAheadLog) append(records []*logRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	self.Lock()
+	defer self.Unlock()
+	if self.file == nil {
+		return errors.New("write-ahead log is closed")
+	}
+	written, err := writeLogRecords(self.writer, records)
+	self.sizes[self.active] += written
+	if err != nil {
+		return err
+	}
+	return self.writer.Flush()
+}
+
+func writeLogRecords(writer io.Writer, records []*logRecord) (int64, error) {
+	written := int64(0)
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return written, err
+		}
+		line = append(line, '\n')
+		if _, err := writer.Write(line); err != nil {
+			return written, err
+		}
+		written += int64(len(line))
+	}
+	return written, nil
+}
+
+// Rotate seals the active segment and starts a new one. The returned segment
+// can be removed once all commands written to it are delivered.
+func (self *WriteAheadLog) Rotate() (uint64, error) {
+	self.Lock()
+	defer self.Unlock()
+	if self.file == nil {
+		return 0, errors.New("write-ahead log is closed")
+	}
+	if err := self.closeActiveSegment(); err != nil {
+		return 0, err
+	}
+	sealed := self.active
+	self.active++
+	return sealed, self.openActiveSegment()
+}
+
+func (self *WriteAheadLog) closeActiveSegment() error {
+	if err := self.writer.Flush(); err != nil {
+		return err
+	}
+	if err := self.file.Sync(); err != nil {
+		return err
+	}
+	err := self.file.Close()
+	self.file = nil
+	self.writer = nil
+	return err
+}
+
+func (self *WriteAheadLog) Remove(segment uint64) error {
+	self.Lock()
+	defer self.Unlock()
+	if segment == self.active && self.file != nil {
+		return fmt.Errorf("could not remove active write-ahead log segment %v", segment)
+	}
+	if err := os.Remove(self.segmentPath(segment)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(self.sizes, segment)
+	return nil
+}
+
+// sealedSegments returns the segments other than the active one, oldest first.
+func (self *WriteAheadLog) sealedSegments() []uint64 {
+	self.Lock()
+	defer self.Unlock()
+	segments := []uint64{}
+	for segment := range self.sizes {
+		if segment != self.active {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Sort(segmentIds(segments))
+	return segments
+}
+
+// readSegment decodes the commands of a sealed segment.
+func (self *WriteAheadLog) readSegment(segment uint64, apply func(command interface{})) error {
+	count, err := readLogFile(self.segmentPath(segment), apply)
+	atomic.AddUint64(&self.replayed, uint64(count))
+	if err != nil {
+		return fmt.Errorf("segment %v: %v", segment, err)
+	}
+	return nil
+}
+
+// readLogFile decodes the commands stored in a file written by writeLogRecords,
+// leaving out the ones removed by tombstones. A record that cannot be decoded,
+// usually one torn by a crash in the middle of a write, ends the file.
+func readLogFile(path string, apply func(command interface{})) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	records := []*logRecord{}
+	// positions lists the records not evicted yet by their content, oldest first.
+	positions := map[string][]int{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, bufferSize), maxLogRecordSize)
+	var readErr error
+	for scanner.Scan() {
+		record := &logRecord{}
+		if readErr = json.Unmarshal(scanner.Bytes(), record); readErr != nil {
+			break
+		}
+		evicted := record.Evicted
+		record.Evicted = false
+		content, _ := json.Marshal(record)
+		key := string(content)
+		if !evicted {
+			positions[key] = append(positions[key], len(records))
+			records = append(records, record)
+		} else if position := positions[key]; len(position) > 0 {
+			records[position[0]] = nil
+			positions[key] = position[1:]
+		}
+	}
+	if readErr == nil {
+		readErr = scanner.Err()
+	}
+
+	count := 0
+	for _, record := range records {
+		if record == nil {
+			continue
+		}
+		command, err := record.command()
+		if err != nil {
+			return count, err
+		}
+		apply(command)
+		count++
+	}
+	return count, readErr
+}
+
+// Size returns the number of bytes held in all segments.
+func (self *WriteAheadLog) Size() int64 {
+	self.Lock()
+	defer self.Unlock()
+	size := int64(0)
+	for _, segmentSize := range self.sizes {
+		size += segmentSize
+	}
+	return size
+}
+
+// ReplayedCount returns the number of commands read back from segments left by a previous run.
+func (self *WriteAheadLog) ReplayedCount() uint64 {
+	return atomic.LoadUint64(&self.replayed)
+}
+
+func (self *WriteAheadLog) Close() error {
+	self.Lock()
+	defer self.Unlock()
+	if self.file == nil {
+		return nil
+	}
+	return self.closeActiveSegment()
+}
+
+func numberToLogNumber(number net.Number) logNumber {
+	switch value := number.(type) {
+	case net.Int32:
+		return logNumber{Type: "int32", Value: strconv.FormatInt(int64(value), 10)}
+	case net.Int64:
+		return logNumber{Type: "int64", Value: strconv.FormatInt(int64(value), 10)}
+	case net.Float32:
+		return logNumber{Type: "float32", Value: strconv.FormatFloat(float64(value), 'g', -1, 32)}
+	default:
+		return logNumber{Type: "float64", Value: strconv.FormatFloat(number.Float64(), 'g', -1, 64)}
+	}
+}
+
+func (self logNumber) number() (net.Number, error) {
+	switch self.Type {
+	case "int32":
+		value, err := strconv.ParseInt(self.Value, 10, 32)
+		return net.Int32(value), err
+	case "int64":
+		value, err := strconv.ParseInt(self.Value, 10, 64)
+		return net.Int64(value), err
+	case "float32":
+		value, err := strconv.ParseFloat(self.Value, 32)
+		return net.Float32(value), err
+	case "float64":
+		value, err := strconv.ParseFloat(self.Value, 64)
+		return net.Float64(value), err
+	default:
+		return nil, fmt.Errorf("unknown number type: %v", self.Type)
+	}
+}
+
+// commandToLogRecord converts one of the command types returned by logRecord.command.
+func commandToLogRecord(command interface{}) *logRecord {
+	switch command := command.(type) {
+	case *net.SeriesCommand:
+		return seriesCommandToLogRecord(command)
+	case *net.PropertyCommand:
+		return propertyCommandToLogRecord(command)
+	case *net.EntityTagCommand:
+		return entityTagCommandToLogRecord(command)
+	default:
+		return messageCommandToLogRecord(command.(*net.MessageCommand))
+	}
+}
+
+func seriesCommandToLogRecord(command *net.SeriesCommand) *logRecord {
+	metrics := map[string]logNumber{}
+	for name, value := range command.Metrics() {
+		metrics[name] = numberToLogNumber(value)
+	}
+	return &logRecord{
+		Command:   "series",
+		Entity:    command.Entity(),
+		Metrics:   metrics,
+		Tags:      command.Tags(),
+		Timestamp: command.Timestamp(),
+	}
+}
+func propertyCommandToLogRecord(command *net.PropertyCommand) *logRecord {
+	return &logRecord{
+		Command:   "property",
+		Entity:    command.Entity(),
+		PropType:  command.PropType(),
+		Key:       command.Key(),
+		Tags:      command.Tags(),
+		Timestamp: command.Timestamp(),
+	}
+}
+func entityTagCommandToLogRecord(command *net.EntityTagCommand) *logRecord {
+	return &logRecord{
+		Command: "entity",
+		Entity:  command.Entity(),
+		Tags:    command.Tags(),
+	}
+}
+func messageCommandToLogRecord(command *net.MessageCommand) *logRecord {
+	return &logRecord{
+		Command:   "message",
+		Entity:    command.Entity(),
+		Message:   command.Message(),
+		Tags:      command.Tags(),
+		Timestamp: command.Timestamp(),
+	}
+}
+
+// command rebuilds the command stored in the record. It returns one of
+// *net.SeriesCommand, *net.PropertyCommand, *net.EntityTagCommand or *net.MessageCommand.
+func (self *logRecord) command() (interface{}, error) {
+	switch self.Command {
+	case "series":
+		var command *net.SeriesCommand
+		for _, name := range sortedKeys(self.Metrics) {
+			value, err := self.Metrics[name].number()
+			if err != nil {
+				return nil, err
+			}
+			if command == nil {
+				command = net.NewSeriesCommand(self.Entity, name, value)
+			} else {
+				command.SetMetricValue(name, value)
+			}
+		}
+		if command == nil {
+			return nil, errors.New("series command without metrics")
+		}
+		for name, value := range self.Tags {
+			command.SetTag(name, value)
+		}
+		if self.Timestamp != nil {
+			command.SetTimestamp(*self.Timestamp)
+		}
+		return command, nil
+	case "property":
+		var command *net.PropertyCommand
+		for _, name := range sortedStringKeys(self.Tags) {
+			if command == nil {
+				command = net.NewPropertyCommand(self.PropType, self.Entity, name, self.Tags[name])
+			} else {
+				command.SetTag(name, self.Tags[name])
+			}
+		}
+		if command == nil {
+			return nil, errors.New("property command without tags")
+		}
+		for name, value := range self.Key {
+			command.SetKey(name, value)
+		}
+		if self.Timestamp != nil {
+			command.SetTimestamp(*self.Timestamp)
+		}
+		return command, nil
+	case "entity":
+		var command *net.EntityTagCommand
+		for _, name := range sortedStringKeys(self.Tags) {
+			if command == nil {
+				command = net.NewEntityTagCommand(self.Entity, name, self.Tags[name])
+			} else {
+				command.SetTag(name, self.Tags[name])
+			}
+		}
+		if command == nil {
+			return nil, errors.New("entity command without tags")
+		}
+		return command, nil
+	case "message":
+		command := net.NewMessageCommand(self.Entity, self.Message)
+		for name, value := range self.Tags {
+			command.SetTag(name, value)
+		}
+		if self.Timestamp != nil {
+			command.SetTimestamp(*self.Timestamp)
+		}
+		return command, nil
+	default:
+		return nil, fmt.Errorf("unknown command: %v", self.Command)
+	}
+}
+
+func sortedKeys(metrics map[string]logNumber) []string {
+	keys := make([]string, 0, len(metrics))
+	for key := range metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+func sortedStringKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
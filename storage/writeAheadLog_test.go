@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/axibase/atsd-api-go/net"
+)
+
+func TestWriteAheadLogReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	memstore, _ := NewMemStore(minMemoryLimit)
+	wal, err := OpenWriteAheadLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memstore.AttachWriteAheadLog(wal)
+
+	memstore.AppendSeriesCommands([]*net.SeriesCommand{
+		net.NewSeriesCommand("entity001", "metric001", net.Float64(1.5)).SetTag("tag", "value").SetTimestamp(net.Millis(1000)),
+		net.NewSeriesCommand("entity001", "metric002", net.Int64(2)).SetTimestamp(net.Millis(1000)),
+	})
+	memstore.AppendPropertyCommands([]*net.PropertyCommand{
+		net.NewPropertyCommand("type001", "entity001", "name", "value").SetKey("key", "value"),
+	})
+	_, _, _, _, delivered := memstore.ReleaseAll()
+
+	memstore.AppendMessageCommands([]*net.MessageCommand{
+		net.NewMessageCommand("entity001", "message001").SetTag("severity", "WARNING"),
+	})
+	memstore.AppendEntityTagCommands([]*net.EntityTagCommand{
+		net.NewEntityTagCommand("entity001", "name", "value"),
+	})
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, _ := NewMemStore(minMemoryLimit)
+	wal, err = OpenWriteAheadLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed.AttachWriteAheadLog(wal)
+	if replayed.Size() != 5 || wal.ReplayedCount() != 5 {
+		t.Error("undelivered commands were not replayed: size = ", replayed.Size(), " replayed = ", wal.ReplayedCount())
+	}
+	if replayed.SeriesCommandCount() != 2 || replayed.PropertiesCount() != 1 || replayed.MessagesCount() != 1 || replayed.EntitiesCount() != 1 {
+		t.Error("unexpected replayed commands: ", replayed.SeriesCommandCount(), replayed.PropertiesCount(), replayed.MessagesCount(), replayed.EntitiesCount())
+	}
+
+	delivered()
+	_, _, _, _, delivered = replayed.ReleaseAll()
+	delivered()
+	wal.Close()
+
+	wal, err = OpenWriteAheadLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if segments := wal.sealedSegments(); len(segments) != 0 || wal.Size() != 0 {
+		t.Error("delivered segments were not removed: ", segments)
+	}
+}
+
+func TestWriteAheadLogKeepsUnreplayedSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	memstore, _ := NewMemStore(minMemoryLimit)
+	wal, err := OpenWriteAheadLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memstore.AttachWriteAheadLog(wal)
+	memstore.AppendMessageCommands([]*net.MessageCommand{
+		net.NewMessageCommand("entity001", "message001"),
+		net.NewMessageCommand("entity001", "message002"),
+	})
+	wal.Close()
+
+	small, _ := NewMemStore(minMemoryLimit)
+	small.Quotas.MessageCommands = 1
+	wal, err = OpenWriteAheadLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small.AttachWriteAheadLog(wal)
+	if small.MessagesCount() != 1 {
+		t.Error("unexpected replayed messages: ", small.MessagesCount())
+	}
+	segments := wal.sealedSegments()
+	wal.Close()
+	if len(segments) != 1 {
+		t.Fatal("the partly replayed segment was removed: ", segments)
+	}
+
+	corrupt := wal.segmentPath(segments[0])
+	if err := ioutil.WriteFile(corrupt, []byte("{not json\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replayed, _ := NewMemStore(minMemoryLimit)
+	wal, err = OpenWriteAheadLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	replayed.AttachWriteAheadLog(wal)
+	if _, err := os.Stat(corrupt); err != nil {
+		t.Error("the unreadable segment was removed: ", err)
+	}
+	if replayed.MessagesCount() != 1 {
+		t.Error("unexpected replayed messages: ", replayed.MessagesCount())
+	}
+}
+
+func TestWriteAheadLogSkipsEvictedCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	memstore, _ := NewMemStore(minMemoryLimit)
+	memstore.Quotas.MessageCommands = 2
+	memstore.OverflowPolicy = DropOldest
+	wal, err := OpenWriteAheadLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memstore.AttachWriteAheadLog(wal)
+	for _, message := range []string{"message001", "message001", "message002"} {
+		memstore.AppendMessageCommands([]*net.MessageCommand{net.NewMessageCommand("entity001", message)})
+	}
+	memstore.AppendSeriesCommands(seriesCommands("entity001", 1))
+	wal.Close()
+
+	replayed, _ := NewMemStore(minMemoryLimit)
+	wal, err = OpenWriteAheadLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	replayed.AttachWriteAheadLog(wal)
+	if replayed.MessagesCount() != 2 || replayed.SeriesCommandCount() != 1 || wal.ReplayedCount() != 3 {
+		t.Fatal("unexpected replayed commands: ", replayed.MessagesCount(), replayed.SeriesCommandCount(), wal.ReplayedCount())
+	}
+	_, _, _, messages, _ := replayed.ReleaseAll()
+	if messages[0].Message() != "message001" || messages[1].Message() != "message002" {
+		t.Error("the evicted message was replayed: ", messages)
+	}
+}